@@ -0,0 +1,31 @@
+// Author: Li Xi
+//
+// Package clock abstracts time so the agent's retry/backoff/stagger
+// loops can be driven deterministically in tests instead of depending on
+// real wall time.
+//
+package clock
+
+import "time"
+
+// Clock is the time source used throughout the agent's retry and
+// scheduling code.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+// New returns a Clock backed by the real wall clock / time.After.
+func New() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,58 @@
+// Author: Li Xi
+//
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a Clock that only advances when Advance is called, for
+// deterministic tests of code built on Clock.
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// NewFakeClock builds a FakeClock starting at start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (fake *FakeClock) Now() time.Time {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return fake.now
+}
+
+func (fake *FakeClock) After(d time.Duration) <-chan time.Time {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	ch := make(chan time.Time, 1)
+	fake.waiters = append(fake.waiters, fakeWaiter{deadline: fake.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing (in order) any waiters
+// whose deadline is now in the past.
+func (fake *FakeClock) Advance(d time.Duration) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.now = fake.now.Add(d)
+
+	remaining := fake.waiters[:0]
+	for _, waiter := range fake.waiters {
+		if !waiter.deadline.After(fake.now) {
+			waiter.ch <- fake.now
+		} else {
+			remaining = append(remaining, waiter)
+		}
+	}
+	fake.waiters = remaining
+}
@@ -0,0 +1,310 @@
+// Author: Li Xi
+//
+// Pluggable service/host management backends, so that the leader
+// election loop does not have to hard-code a local `clownf` exec. This
+// lets an agent drive remote nodes over SSH, or run unit tests without
+// spawning processes.
+//
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ServiceBackend performs the mount/umount/status operations for a
+// Lustre service (OST/MDT/MGS instance). hostname is the node the
+// service instance actually lives on (so SSHBackend knows which peer to
+// dial), and ctx bounds operations that must not outlive a shutdown or
+// pre-release deadline.
+type ServiceBackend interface {
+	Mount(ctx context.Context, hostname, serviceName string) (stdout, stderr string, err error)
+	Umount(ctx context.Context, hostname, serviceName string) (stdout, stderr string, err error)
+	Status(ctx context.Context, hostname, serviceName string) (stdout, stderr string, err error)
+}
+
+// HostBackend performs the start/stop/ping operations for a monitored
+// host. hostname is both the operation's target and the identity of the
+// op, so it doubles as the SSH dial target already.
+type HostBackend interface {
+	Start(hostname string) (stdout, stderr string, err error)
+	Stop(hostname string) (stdout, stderr string, err error)
+	Ping(hostname string) (stdout, stderr string, err error)
+}
+
+// runClownf execs the clownf CLI and captures stdout/stderr, matching
+// the buffering/logging conventions used throughout this package.
+func runClownf(ctx context.Context, args ...string) (string, string, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "clownf", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// ClownfBackend is the original behavior: every operation shells out to
+// the locally installed `clownf` CLI.
+type ClownfBackend struct{}
+
+func (ClownfBackend) Mount(ctx context.Context, hostname, serviceName string) (string, string, error) {
+	return runClownf(ctx, "service", "mount", serviceName)
+}
+
+func (ClownfBackend) Umount(ctx context.Context, hostname, serviceName string) (string, string, error) {
+	return runClownf(ctx, "service", "umount", serviceName)
+}
+
+func (ClownfBackend) Status(ctx context.Context, hostname, serviceName string) (string, string, error) {
+	return runClownf(ctx, "service", "status", serviceName)
+}
+
+func (ClownfBackend) Start(hostname string) (string, string, error) {
+	return runClownf(context.Background(), "host", "start", hostname)
+}
+
+func (ClownfBackend) Stop(hostname string) (string, string, error) {
+	return runClownf(context.Background(), "host", "stop", hostname)
+}
+
+func (ClownfBackend) Ping(hostname string) (string, string, error) {
+	return runClownf(context.Background(), "host", "ping", hostname)
+}
+
+// SSHBackend runs the equivalent `clownf` commands over a pool of SSH
+// connections, so the agent can drive remote nodes that don't have
+// clownf on PATH locally.
+type SSHBackend struct {
+	// User is the SSH user used for every connection in the pool.
+	User string
+	// AuthMethods are the SSH client auth methods, e.g. public key.
+	AuthMethods []ssh.AuthMethod
+
+	mutex   sync.Mutex
+	clients map[string]*ssh.Client
+}
+
+// NewSSHBackend builds an SSHBackend with an empty connection pool.
+func NewSSHBackend(user string, authMethods []ssh.AuthMethod) *SSHBackend {
+	return &SSHBackend{
+		User:        user,
+		AuthMethods: authMethods,
+		clients:     make(map[string]*ssh.Client),
+	}
+}
+
+func (backend *SSHBackend) clientFor(hostname string) (*ssh.Client, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if client, ok := backend.clients[hostname]; ok {
+		return client, nil
+	}
+
+	config := &ssh.ClientConfig{
+		User:            backend.User,
+		Auth:            backend.AuthMethods,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	client, err := ssh.Dial("tcp", hostname+":22", config)
+	if err != nil {
+		return nil, err
+	}
+	backend.clients[hostname] = client
+	return client, nil
+}
+
+// evict drops hostname's pooled client so the next clientFor call dials
+// a fresh connection, instead of a dropped connection permanently
+// breaking that host for the life of the process.
+func (backend *SSHBackend) evict(hostname string) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	delete(backend.clients, hostname)
+}
+
+// run dials hostname and runs the clownf command built from args,
+// returning ctx.Err() (without waiting further) if ctx is done before
+// the session finishes, so a caller like SAPreReleaseHook can bound a
+// stuck remote umount. Any error other than a non-zero clownf exit
+// evicts the pooled client for hostname, so a dropped connection gets
+// re-dialed on the next call instead of permanently breaking that host.
+func (backend *SSHBackend) run(ctx context.Context, hostname string, args ...string) (string, string, error) {
+	client, err := backend.clientFor(hostname)
+	if err != nil {
+		return "", "", err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		backend.evict(hostname)
+		return "", "", err
+	}
+	defer session.Close()
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run("clownf " + strings.Join(args, " "))
+	}()
+
+	select {
+	case err := <-done:
+		// A non-zero clownf exit is a normal result, not a broken
+		// connection; only evict the pooled client for errors that
+		// aren't an *ssh.ExitError (i.e. the session/transport itself
+		// failed).
+		if _, isExitError := err.(*ssh.ExitError); err != nil && !isExitError {
+			backend.evict(hostname)
+		}
+		return stdout.String(), stderr.String(), err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		backend.evict(hostname)
+		return stdout.String(), stderr.String(), ctx.Err()
+	}
+}
+
+func (backend *SSHBackend) Mount(ctx context.Context, hostname, serviceName string) (string, string, error) {
+	return backend.run(ctx, hostname, "service", "mount", serviceName)
+}
+
+func (backend *SSHBackend) Umount(ctx context.Context, hostname, serviceName string) (string, string, error) {
+	return backend.run(ctx, hostname, "service", "umount", serviceName)
+}
+
+func (backend *SSHBackend) Status(ctx context.Context, hostname, serviceName string) (string, string, error) {
+	return backend.run(ctx, hostname, "service", "status", serviceName)
+}
+
+func (backend *SSHBackend) Start(hostname string) (string, string, error) {
+	return backend.run(context.Background(), hostname, "host", "start", hostname)
+}
+
+func (backend *SSHBackend) Stop(hostname string) (string, string, error) {
+	return backend.run(context.Background(), hostname, "host", "stop", hostname)
+}
+
+func (backend *SSHBackend) Ping(hostname string) (string, string, error) {
+	return backend.run(context.Background(), hostname, "host", "ping", hostname)
+}
+
+// MockBackend is a ServiceBackend/HostBackend for tests: it never
+// spawns a process, and returns whatever has been configured via Err.
+type MockBackend struct {
+	mutex sync.Mutex
+	// Err is returned by every operation when non-nil.
+	Err error
+	// Calls records "<op> <name>" for every invocation, in order.
+	Calls []string
+}
+
+func (backend *MockBackend) record(op, name string) (string, string, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	backend.Calls = append(backend.Calls, fmt.Sprintf("%s %s", op, name))
+	return "", "", backend.Err
+}
+
+func (backend *MockBackend) Mount(ctx context.Context, hostname, serviceName string) (string, string, error) {
+	return backend.record("mount", serviceName)
+}
+
+func (backend *MockBackend) Umount(ctx context.Context, hostname, serviceName string) (string, string, error) {
+	return backend.record("umount", serviceName)
+}
+
+func (backend *MockBackend) Status(ctx context.Context, hostname, serviceName string) (string, string, error) {
+	return backend.record("status", serviceName)
+}
+
+func (backend *MockBackend) Start(hostname string) (string, string, error) {
+	return backend.record("start", hostname)
+}
+
+func (backend *MockBackend) Stop(hostname string) (string, string, error) {
+	return backend.record("stop", hostname)
+}
+
+func (backend *MockBackend) Ping(hostname string) (string, string, error) {
+	return backend.record("ping", hostname)
+}
+
+// BackendConfig carries the --backend flag's selection plus, for "ssh",
+// the credentials SSHBackend dials remote nodes with. It's resolved once
+// in main (parseAgentFlags + loadSSHAuthMethods) and carried on each
+// ServiceAgent/HostAgent so a later RCBackend reload can rebuild an
+// SSHBackend with the same credentials.
+type BackendConfig struct {
+	// Name selects the implementation: "clownf" (default), "ssh" or
+	// "mock".
+	Name string
+	// SSHUser is the SSH user used for every connection when Name is
+	// "ssh".
+	SSHUser string
+	// SSHKeyFile is the path to the private key used to authenticate
+	// when Name is "ssh", as set by --ssh-key-file. Resolved into
+	// SSHAuthMethods once, in main, via loadSSHAuthMethods.
+	SSHKeyFile string
+	// SSHAuthMethods are the SSH client auth methods (e.g. public key)
+	// used when Name is "ssh".
+	SSHAuthMethods []ssh.AuthMethod
+}
+
+// loadSSHAuthMethods reads and parses the private key at keyFile into a
+// single ssh.AuthMethod, so --backend ssh can actually authenticate
+// against a real sshd instead of dialing with an empty auth list.
+func loadSSHAuthMethods(keyFile string) ([]ssh.AuthMethod, error) {
+	if keyFile == "" {
+		return nil, fmt.Errorf("--ssh-key-file is required when --backend is ssh")
+	}
+
+	keyBytes, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+}
+
+// newServiceBackend and newHostBackend select the backend implementation
+// named by conf.Name (the --backend flag / RCBackend runtime config
+// field).
+func newServiceBackend(conf BackendConfig) ServiceBackend {
+	switch conf.Name {
+	case "ssh":
+		return NewSSHBackend(conf.SSHUser, conf.SSHAuthMethods)
+	case "mock":
+		return &MockBackend{}
+	default:
+		return ClownfBackend{}
+	}
+}
+
+func newHostBackend(conf BackendConfig) HostBackend {
+	switch conf.Name {
+	case "ssh":
+		return NewSSHBackend(conf.SSHUser, conf.SSHAuthMethods)
+	case "mock":
+		return &MockBackend{}
+	default:
+		return ClownfBackend{}
+	}
+}
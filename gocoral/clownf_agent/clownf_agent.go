@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"math/rand"
 	"strings"
 	"time"
@@ -13,27 +14,171 @@ import (
 	"os/exec"
 	"syscall"
 	"fmt"
+	"flag"
 	"sync"
 	"bytes"
 	"sort"
 	yaml "gopkg.in/yaml.v2"
+	"github.com/armon/go-metrics"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/api/watch"
 	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-uuid"
 	"github.com/pelletier/go-toml"
+	"github.com/LiXi-storage/barreleye/gocoral/hooks"
+	"github.com/LiXi-storage/barreleye/gocoral/retry"
 )
 
 const (
 	// lockPath is the path used to acquire a coordinating lock
 	// for a highly-available deploy.
 	SessionTTLSeconds = 10
+	// PlanRetryInterval is how long SAPlanRun/HAPlanRun wait before
+	// re-establishing a watch.Plan after it returns an error.
+	PlanRetryInterval = 5 * time.Second
+	// StartupRetryTimeout bounds how long CreateServiceAgents/
+	// CreateLustreHostAgents retry a fragile Consul operation before
+	// giving up and returning the error to main().
+	StartupRetryTimeout = 30 * time.Second
+	// StartupRetryInterval is the polling interval used while retrying
+	// within StartupRetryTimeout.
+	StartupRetryInterval = 2 * time.Second
+	// VersionCheckRetryTimeout bounds how long VersionCheckOnce retries a
+	// failing `clownf version_check` exec before giving up until the
+	// next scheduled VersionCheck cycle.
+	VersionCheckRetryTimeout = 60 * time.Second
+	// VersionCheckRetryInterval is the polling interval used while
+	// retrying within VersionCheckRetryTimeout.
+	VersionCheckRetryInterval = 10 * time.Second
 )
 
+// LoggerConfig holds the knobs used to build the agent's root logger.
+// Fields are populated from CLI flags. Level and Format fall back to
+// CLOWNF_LOG_LEVEL/CLOWNF_LOG_FORMAT when their flag is not given; the
+// other fields have no environment variable.
+type LoggerConfig struct {
+	// Level is one of trace|debug|info|warn|error
+	Level string
+	// Format is either "text" (the historical key=value output) or
+	// "json", for ingestion by log pipelines such as ELK/Loki/Splunk.
+	Format string
+	// File is the path to log to instead of stderr. Empty keeps logging
+	// on stderr.
+	File string
+	// RotateBytes rotates File once it grows past this size. Zero
+	// disables size-based rotation.
+	RotateBytes int64
+	// RotateDuration rotates File once it has been open longer than
+	// this. Zero disables time-based rotation.
+	RotateDuration time.Duration
+}
+
+// newAgentLogger builds the root hclog.Logger for the agent from a
+// LoggerConfig, used by main() and shared by every long-running loop
+// (SAMaintainService, HAMaintainHost, loadConfig, the plan handlers) so
+// that log level/format is consistent across the whole process.
+func newAgentLogger(conf LoggerConfig) log.Logger {
+	opts := &log.LoggerOptions{
+		Name:       "clownf_agent",
+		Level:      log.LevelFromString(conf.Level),
+		JSONFormat: conf.Format == "json",
+	}
+
+	if conf.File != "" {
+		logFile, err := newLogFile(conf.File, conf.RotateBytes, conf.RotateDuration)
+		if err != nil {
+			log.New(&log.LoggerOptions{Name: "clownf_agent"}).Error(
+				"failed to open log file, falling back to stderr",
+				"error", err, "file", conf.File)
+		} else {
+			opts.Output = logFile
+		}
+	}
+
+	return log.New(opts)
+}
+
+// AgentFlags holds the command-line configuration parsed once at
+// process startup in main().
+type AgentFlags struct {
+	Logger LoggerConfig
+	// MetricsAddr is the bind address for the /metrics endpoint, e.g.
+	// "127.0.0.1:9520". Empty disables the endpoint.
+	MetricsAddr string
+	// Backend selects the ServiceBackend/HostBackend implementation
+	// (and, for "ssh", the credentials it dials remote nodes with).
+	Backend BackendConfig
+	// GracefulTimeout bounds how long main waits, after signaling all
+	// agents to exit, for them to drain before forcing lock/session
+	// cleanup. Mirrors the Consul agent's gracefulTimeout.
+	GracefulTimeout time.Duration
+}
+
+// parseAgentFlags reads --log-format/--log-level (or their
+// CLOWNF_LOG_FORMAT/CLOWNF_LOG_LEVEL environment equivalents), the
+// --log-file/--log-rotate-bytes/--log-rotate-duration file logging
+// knobs, --metrics-addr, and --graceful-timeout into an AgentFlags.
+func parseAgentFlags() AgentFlags {
+	defaultFormat := "text"
+	if envFormat := os.Getenv("CLOWNF_LOG_FORMAT"); envFormat != "" {
+		defaultFormat = envFormat
+	}
+	defaultLevel := "info"
+	if envLevel := os.Getenv("CLOWNF_LOG_LEVEL"); envLevel != "" {
+		defaultLevel = envLevel
+	}
+
+	format := flag.String("log-format", defaultFormat,
+			       "log output format: text or json")
+	level := flag.String("log-level", defaultLevel,
+			      "log level: trace, debug, info, warn or error")
+	logFile := flag.String("log-file", "",
+				"path to log to instead of stderr (disabled if empty)")
+	logRotateBytes := flag.Int64("log-rotate-bytes", 0,
+				      "rotate --log-file once it exceeds this many bytes (disabled if 0)")
+	logRotateDuration := flag.Duration("log-rotate-duration", 0,
+					    "rotate --log-file once it has been open this long (disabled if 0)")
+	metricsAddr := flag.String("metrics-addr", "",
+				    "bind address for the /metrics endpoint, e.g. 127.0.0.1:9520 (disabled if empty)")
+	backend := flag.String("backend", "clownf",
+				"service/host management backend: clownf, ssh or mock")
+	sshUser := flag.String("ssh-user", "root",
+				"SSH user used to dial remote nodes when --backend is ssh")
+	sshKeyFile := flag.String("ssh-key-file", "",
+				   "path to a private key used to authenticate when --backend is ssh (required for ssh)")
+	gracefulTimeout := flag.Duration("graceful-timeout", 5*time.Second,
+					  "how long to wait for agents to drain on SIGINT/SIGTERM before forcing lock/session cleanup")
+	flag.Parse()
+
+	return AgentFlags{
+		Logger: LoggerConfig{
+			Level:          *level,
+			Format:         *format,
+			File:           *logFile,
+			RotateBytes:    *logRotateBytes,
+			RotateDuration: *logRotateDuration,
+		},
+		MetricsAddr: *metricsAddr,
+		Backend: BackendConfig{
+			Name:       *backend,
+			SSHUser:    *sshUser,
+			SSHKeyFile: *sshKeyFile,
+		},
+		GracefulTimeout: *gracefulTimeout,
+	}
+}
+
 type LustreService struct {
 	// If OST/MDT, then lustre-MDT0000 or lustre-OST0000
 	// If MGS then mgs_id in clownfish.conf
 	LSServiceName string
+	// LSFsname is the Lustre filesystem this service belongs to, empty
+	// for MGS (which isn't scoped to a single filesystem). Used to
+	// label per-filesystem metrics.
+	LSFsname string
+	// LSRole is one of "ost", "mdt" or "mgs". Used to label per-role
+	// metrics.
+	LSRole string
 }
 
 type LustreServiceInstance struct {
@@ -77,6 +222,23 @@ type ClownfishConfig struct {
 	CCLustres []LustreFileSystem `toml:"filesystems" yaml:"filesystems"`
 	CCMgsList []LustreMgs `toml:"mgs_list" yaml:"mgs_list"`
 	CCSSHHosts []SSHHost `toml:"hosts" yaml:"hosts"`
+	CCHooks hooks.Config `toml:"hooks" yaml:"hooks"`
+	CCTelemetry TelemetryConfig `toml:"telemetry" yaml:"telemetry"`
+}
+
+// TelemetryConfig selects and configures the go-metrics sink used for the
+// named counters/timers/gauges in metrics.go, independent of the
+// Prometheus gauges that back the /metrics endpoint directly.
+type TelemetryConfig struct {
+	// TCSink is one of "inmem" (default), "statsd", "datadog" or
+	// "prometheus".
+	TCSink string `toml:"sink" yaml:"sink"`
+	// TCAddr is the sink's destination, e.g. "127.0.0.1:8125" for
+	// statsd/datadog. Unused for "inmem" and "prometheus".
+	TCAddr string `toml:"addr" yaml:"addr"`
+	// TCServiceName prefixes every emitted metric name, "barreleye" if
+	// unset.
+	TCServiceName string `toml:"service_name" yaml:"service_name"`
 }
 
 type SSHHostList []SSHHost
@@ -94,6 +256,40 @@ func (list SSHHostList) Swap(i, j int) {
 
 type RuntimeConfig struct {
 	RCAutostartEnabled bool `yaml:"autostart"`
+	// RCRetryBaseSeconds is the wait between mount/start attempts while
+	// they succeed, doubled on every consecutive failure (so already
+	// twice this after the first failure) up to RCRetryMaxSeconds.
+	RCRetryBaseSeconds int `yaml:"retry_base_seconds"`
+	RCRetryMaxSeconds int `yaml:"retry_max_seconds"`
+	// RCFailureThreshold is the number of consecutive failures after
+	// which the circuit opens and attempts are suppressed for
+	// RCCoolDownSeconds.
+	RCFailureThreshold int `yaml:"failure_threshold"`
+	RCCoolDownSeconds int `yaml:"cool_down_seconds"`
+	// RCBackend selects the ServiceBackend/HostBackend implementation:
+	// "clownf" (default), "ssh" or "mock".
+	RCBackend string `yaml:"backend"`
+	// RCSessionTTLSeconds overrides the Consul session TTL used for the
+	// next lock (re)acquisition. Zero keeps SessionTTLSeconds. Applied
+	// between lock holds only (see SARefreshSessionTTL/
+	// HARefreshSessionTTL) so a change never disrupts a held lock.
+	RCSessionTTLSeconds int `yaml:"session_ttl_seconds"`
+}
+
+// defaultRuntimeConfig returns the RuntimeConfig used before any Consul
+// KV value has been observed: attempts every 10s and retries forever (no
+// circuit breaker) when retry tuning is left unset, but backs off up to
+// 300s on consecutive failures. backend is the
+// value of the --backend flag, used until a Consul KV watch overrides it.
+func defaultRuntimeConfig(backend string) RuntimeConfig {
+	return RuntimeConfig{
+		RCAutostartEnabled: false,
+		RCRetryBaseSeconds: SessionTTLSeconds,
+		RCRetryMaxSeconds:  300,
+		RCFailureThreshold: 0,
+		RCCoolDownSeconds:  300,
+		RCBackend:          backend,
+	}
 }
 
 func lustreOSTIndex2String(indexNumber int) (string, error) {
@@ -151,6 +347,8 @@ func loadConfig(logger log.Logger) (*ClownfishConfig, error) {
 			}
 			serviceName := lustrefs.LFFsname + "-" + ostIndexString
 			ost.LOstService.LSServiceName = serviceName
+			ost.LOstService.LSFsname = lustrefs.LFFsname
+			ost.LOstService.LSRole = "ost"
 			for i := range ost.LOstInstances {
 				ost.LOstInstances[i].LSService = &ost.LOstService
 			}
@@ -165,6 +363,8 @@ func loadConfig(logger log.Logger) (*ClownfishConfig, error) {
 			}
 			serviceName := lustrefs.LFFsname + "-" + mdtIndexString
 			mdt.LMdtService.LSServiceName = serviceName
+			mdt.LMdtService.LSFsname = lustrefs.LFFsname
+			mdt.LMdtService.LSRole = "mdt"
 			for i := range mdt.LMdtInstances {
 				mdt.LMdtInstances[i].LSService = &mdt.LMdtService
 			}
@@ -174,6 +374,7 @@ func loadConfig(logger log.Logger) (*ClownfishConfig, error) {
 	for i := range conf.CCMgsList {
 		mgs := &conf.CCMgsList[i]
 		mgs.LMgsService.LSServiceName = mgs.LMgsID
+		mgs.LMgsService.LSRole = "mgs"
 		for i := range mgs.LMgsInstances {
 			mgs.LMgsInstances[i].LSService = &mgs.LMgsService
 		}
@@ -230,6 +431,27 @@ func filterLocalServices(logger log.Logger, config *ClownfishConfig) (*LocalServ
 	return local, nil
 }
 
+// newAgentExitChannel derives a per-agent exit channel chained off
+// parent (the process-wide exitChannel): it closes when parent closes,
+// or immediately when the returned cancel func is called, whichever
+// happens first. This lets handleConfigReload stop a single removed
+// agent's goroutines without tearing down every other agent.
+func newAgentExitChannel(parent <-chan struct{}) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() { close(ch) })
+	}
+	go func() {
+		select {
+		case <-parent:
+			cancel()
+		case <-ch:
+		}
+	}()
+	return ch, cancel
+}
+
 type ServiceStatus string
 
 const (
@@ -244,6 +466,10 @@ const (
 type ServiceAgent struct {
 	// Service name this agent is managing
 	SAServiceName string
+	// SAFsname/SARole label the per-filesystem/per-role metrics gauges;
+	// see LustreService.LSFsname/LSRole.
+	SAFsname string
+	SARole   string
 	// Client to connect to Consul
 	SAConsulClient *api.Client
 	// Status of the service
@@ -255,6 +481,36 @@ type ServiceAgent struct {
 	SALockKey string
 	SAConfigKey string
 	SARuntimeConfig RuntimeConfig
+	// SABackendConfig is the backend selection/SSH credentials SABackend
+	// was last built from, kept so a later RCBackend reload can rebuild
+	// an SSHBackend with the same credentials.
+	SABackendConfig BackendConfig
+	// SABackend performs the mount/umount/status operations, selected
+	// by the --backend flag / RCBackend runtime config.
+	SABackend ServiceBackend
+	// SAHooks renders and runs the pre_mount/post_mount/pre_umount/
+	// on_status_change hooks configured for this service.
+	SAHooks *hooks.Runner
+	// SAServiceHooks are the hooks configured for this service in
+	// ClownfishConfig.CCHooks.
+	SAServiceHooks hooks.ServiceHooks
+	// SALogger is the root logger's "service" sub-logger, pre-tagged
+	// with this agent's service name so callers don't have to.
+	SALogger log.Logger
+
+	// SAExitChannel closes when either the process-wide exitChannel
+	// closes or SACancel is called, so this agent's goroutines can be
+	// stopped individually by a config reload that removes its service
+	// without affecting any other agent.
+	SAExitChannel <-chan struct{}
+	// SACancel stops this agent's goroutines without closing the
+	// process-wide exitChannel. Safe to call more than once.
+	SACancel func()
+
+	// SALeaderMutex guards SAIsLeader, which SAReconcile checks against
+	// Consul's view of SALockKey to catch drift.
+	SALeaderMutex sync.Mutex
+	SAIsLeader    bool
 }
 
 func (agent *ServiceAgent) SAMaintainService(logger log.Logger,
@@ -263,8 +519,11 @@ func (agent *ServiceAgent) SAMaintainService(logger log.Logger,
 	waitGroup.Add(1)
 	defer waitGroup.Done()
 
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
+	localHostname, err := os.Hostname()
+	if err != nil {
+		logger.Error("failed to get local hostname", "error", err)
+	}
+
 	var newStatus ServiceStatus
 
 	status := SSUnknown
@@ -272,48 +531,57 @@ func (agent *ServiceAgent) SAMaintainService(logger log.Logger,
 	var autostartEnabled bool
 	var oldAutostartEnabled bool
 	first := true
+	retryStrategy := NewTimeoutRetryStrategy(agent.SARuntimeConfig)
 	for {
+		retryStrategy.applyTuning(agent.SARuntimeConfig)
 		autostartEnabled = agent.SARuntimeConfig.RCAutostartEnabled
 		if first || oldAutostartEnabled != autostartEnabled {
 			if autostartEnabled {
-				logger.Info("auotostart is enabled", "service", agent.SAServiceName)
+				logger.Info("auotostart is enabled")
 			} else {
-				logger.Info("auotostart is disabled", "service", agent.SAServiceName)
+				logger.Info("auotostart is disabled")
 			}
 			first = false
 		}
 		oldAutostartEnabled = autostartEnabled
-		if autostartEnabled {
+		if autostartEnabled && !retryStrategy.CircuitOpen() {
 			if status == SSUnknown || status == SSMountFailed {
-				logger.Info("starting service", "service", agent.SAServiceName)
+				logger.Info("starting service")
 			}
-			cmd := exec.Command("clownf", "service", "mount", agent.SAServiceName)
-			stdout.Reset()
-			stderr.Reset()
-			cmd.Stdout = &stdout
-			cmd.Stderr = &stderr
+			agent.SAPublishFence(logger, localHostname)
+			hookData := hooks.TemplateData{Service: agent.SAServiceName, Runtime: agent.SARuntimeConfig}
+			agent.SAHooks.Invoke("service/"+agent.SAServiceName+"/pre_mount",
+					     agent.SAServiceHooks.PreMount, hookData)
+			metricsServiceMountAttemptsTotal.WithLabelValues(agent.SAServiceName).Inc()
 			startTime := time.Now()
-			err := cmd.Run()
-			duration := int(time.Since(startTime).Seconds())
-			stdoutString := stdout.String()
-			stdoutString = strings.Replace(stdoutString, "\n", "\\n", -1)
-			stderrString := stderr.String()
-			stderrString = strings.Replace(stderrString, "\n", "\\n", -1)
+			stdoutRaw, stderrRaw, err := agent.SABackend.Mount(context.Background(), localHostname, agent.SAServiceName)
+			durationSeconds := time.Since(startTime).Seconds()
+			duration := int(durationSeconds)
+			metricsServiceMountDurationSeconds.WithLabelValues(agent.SAServiceName).Observe(durationSeconds)
+			stdoutString := strings.Replace(stdoutRaw, "\n", "\\n", -1)
+			stderrString := strings.Replace(stderrRaw, "\n", "\\n", -1)
 
 			if err != nil {
 				logger.Error("failed to start service",
-					     "service", agent.SAServiceName,
 					     "error", err,
 					     "stdout", stdoutString,
 					     "stderr", stderrString,
 					     "duration", duration)
 				newStatus = SSMountFailed
+				retryStrategy.RecordFailure()
+				metricsServiceMountFailuresTotal.WithLabelValues(agent.SAServiceName).Inc()
 			} else {
 				newStatus = SSMounted
+				retryStrategy.RecordSuccess()
+				agent.SAHooks.Invoke("service/"+agent.SAServiceName+"/post_mount",
+						     agent.SAServiceHooks.PostMount, hookData)
 			}
 
+			metricsServiceStatus.WithLabelValues(agent.SAServiceName, agent.SAFsname, agent.SARole).Set(serviceStatusMetricValue(newStatus))
 			if status != newStatus {
-				logger.Info("status change of service", "service", agent.SAServiceName,
+				agent.SAHooks.Invoke("service/"+agent.SAServiceName+"/on_status_change",
+						     agent.SAServiceHooks.OnStatusChange, hookData)
+				logger.Info("status change of service",
 					    "old", status, "new", newStatus,
 					     "stdout", stdoutString,
 					     "stderr", stderrString,
@@ -321,19 +589,20 @@ func (agent *ServiceAgent) SAMaintainService(logger log.Logger,
 				status = newStatus
 				agent.SAServiceStatus = newStatus
 			} else if (newStatus == SSMounted &&
-				   stdout.String() != MSG_ALREADY_MOUNTED) {
+				   stdoutRaw != MSG_ALREADY_MOUNTED) {
 				logger.Info("mounted service with stale status of mounted",
-					    "service", agent.SAServiceName,
 					     "stdout", stdoutString,
 					     "stderr", stderrString,
 					     "duration", duration)
 			}
+		} else if autostartEnabled {
+			logger.Info("circuit open, suppressing mount attempts")
 		}
 
 		select {
-		case <-time.After(agent.SASessionTTL):
+		case <-time.After(retryStrategy.NextInterval()):
 		case <-exitChannel:
-			logger.Error("exiting from maintaining service", "service", agent.SAServiceName)
+			logger.Error("exiting from maintaining service")
 			return
 		}
 	}
@@ -394,10 +663,18 @@ func (agent *ServiceAgent) SAGetLeaderUUIDWait(exitChannel <-chan struct{}) (str
 
 // SAAcquireLock blocks until the lock is acquired, returning the leaderLostCh
 func (agent *ServiceAgent) SAAcquireLock(exitChannel <-chan struct{}) (<-chan struct{}) {
+	startTime := time.Now()
 	for {
 		// Attempt lock acquisition
 		leaderLostCh, err := agent.SAConsulLock.Lock(exitChannel)
 		if err == nil {
+			metricsConsulLockAcquireSeconds.WithLabelValues(agent.SAServiceName).Observe(
+				time.Since(startTime).Seconds())
+			metricsLeader.WithLabelValues(agent.SAServiceName, agent.SAUuid).Set(1)
+			metrics.MeasureSince([]string{"agent", "lock", "acquire", "duration"}, startTime)
+			metrics.IncrCounter([]string{"agent", "session", "renewals"}, 1)
+			metrics.SetGaugeWithLabels([]string{"agent", "lock", "holder"}, 1,
+						   []metrics.Label{{Name: "service", Value: agent.SAServiceName}})
 			return leaderLostCh
 		}
 
@@ -410,14 +687,47 @@ func (agent *ServiceAgent) SAAcquireLock(exitChannel <-chan struct{}) (<-chan st
 	}
 }
 
+// SARefreshSessionTTL rebuilds SAConsulLock with RCSessionTTLSeconds when
+// it has changed since the lock was last built, so a reloaded
+// session_ttl_seconds takes effect on the next lock (re)acquisition. It
+// must only be called between lock holds (SAMonitorServiceOnce calls it
+// before SAAcquireLock), since rebuilding the lock while it is held would
+// orphan the held session.
+func (agent *ServiceAgent) SARefreshSessionTTL(logger log.Logger) {
+	wanted := agent.SARuntimeConfig.RCSessionTTLSeconds
+	if wanted <= 0 || wanted == agent.SASessionTTLSeconds {
+		return
+	}
+
+	opts := &api.LockOptions{
+		Key:            agent.SALockKey,
+		Value:          []byte(agent.SAUuid),
+		SessionName:    "Clownfish service Lock",
+		MonitorRetries: 5,
+		SessionTTL:     fmt.Sprintf("%ds", wanted),
+	}
+	lock, err := agent.SAConsulClient.LockOpts(opts)
+	if err != nil {
+		logger.Error("failed to rebuild lock with new session TTL", "error", err,
+			     "session_ttl_seconds", wanted)
+		return
+	}
+
+	logger.Info("session TTL changed by reload, rebuilding lock",
+		    "old", agent.SASessionTTLSeconds, "new", wanted)
+	agent.SAConsulLock = lock
+	agent.SASessionTTLSeconds = wanted
+	agent.SASessionTTL = time.Duration(wanted) * time.Second
+}
+
 func (agent *ServiceAgent) SAMonitorServiceOnce(logger log.Logger,
 						waitGroup *sync.WaitGroup,
 						exitChannel <-chan struct{}) (bool) {
 	var err error
+	agent.SARefreshSessionTTL(logger)
 	currentLeader, exiting := agent.SAGetLeaderUUIDWait(exitChannel)
 	if exiting {
-		logger.Info("exiting when trying to get the leader uuid",
-			    "service", agent.SAServiceName)
+		logger.Info("exiting when trying to get the leader uuid")
 		return true
 	}
 
@@ -425,44 +735,66 @@ func (agent *ServiceAgent) SAMonitorServiceOnce(logger log.Logger,
 	// Note that the currentLeader could be empty string
 	if currentLeader != agent.SAUuid {
 		if currentLeader == "" {
-			logger.Info("not able to get the current leader for a long time",
-				    "service", agent.SAServiceName)
+			logger.Info("not able to get the current leader for a long time")
 		} else {
-			logger.Info("the current leader is someone else",
-				    "service", agent.SAServiceName)
+			logger.Info("the current leader is someone else")
 		}
 	}
 
-	logger.Info("trying to get the leadership lock",
-		    "service", agent.SAServiceName)
+	logger.Info("trying to get the leadership lock")
 	leaderLostCh := agent.SAAcquireLock(exitChannel)
 	if leaderLostCh == nil {
-		logger.Info("exiting when trying to get the leadership lock",
-			    "service", agent.SAServiceName)
+		logger.Info("exiting when trying to get the leadership lock")
 		return true
 	}
 
-	logger.Info("got the leadership lock", "service", agent.SAServiceName)
+	logger.Info("got the leadership lock")
+	agent.SALeaderMutex.Lock()
+	agent.SAIsLeader = true
+	agent.SALeaderMutex.Unlock()
+	if exiting := agent.SAWaitFenceClear(logger, exitChannel); exiting {
+		logger.Info("exiting while waiting for the previous fence to clear")
+		return true
+	}
+	if currentLeader != "" && currentLeader != agent.SAUuid {
+		agent.SAFireFailoverEvent(logger, currentLeader)
+	}
 	go agent.SAMaintainService(logger, waitGroup, exitChannel)
 
 	// Monitor a loss of leadership
 	select {
 	case <-leaderLostCh:
-		logger.Info("lost the leadership",
-			    "service", agent.SAServiceName)
+		logger.Info("lost the leadership")
+		agent.SALeaderMutex.Lock()
+		agent.SAIsLeader = false
+		agent.SALeaderMutex.Unlock()
+		metricsLeader.WithLabelValues(agent.SAServiceName, agent.SAUuid).Set(0)
+		metrics.SetGaugeWithLabels([]string{"agent", "lock", "holder"}, 0,
+					   []metrics.Label{{Name: "service", Value: agent.SAServiceName}})
+		agent.SAHooks.Invoke("service/"+agent.SAServiceName+"/on_leader_lost",
+				     agent.SAServiceHooks.OnLeaderLost,
+				     hooks.TemplateData{Service: agent.SAServiceName, Runtime: agent.SARuntimeConfig})
+		agent.SAPreReleaseHook(logger)
 		err = agent.SAConsulLock.Unlock()
 		if err != nil {
 			logger.Error("failed to release the leadership lock",
-				     "error", err, "service", agent.SAServiceName)
+				     "error", err)
 		}
 		return false
 	case <-exitChannel:
-		logger.Info("exiting while holding the leadership lock",
-			    "service", agent.SAServiceName)
+		logger.Info("exiting while holding the leadership lock")
+		agent.SALeaderMutex.Lock()
+		agent.SAIsLeader = false
+		agent.SALeaderMutex.Unlock()
+		agent.SAPreReleaseHook(logger)
 		err = agent.SAConsulLock.Unlock()
 		if err != nil {
 			logger.Error("failed to release the leadership lock",
-				     "error", err, "service", agent.SAServiceName)
+				     "error", err)
+		}
+		if err := agent.SAConsulLock.Destroy(); err != nil {
+			logger.Error("failed to destroy the leadership lock's session",
+				     "error", err)
 		}
 		return true
 	}
@@ -470,14 +802,21 @@ func (agent *ServiceAgent) SAMonitorServiceOnce(logger log.Logger,
 
 func (agent *ServiceAgent) SAPlanRun(logger log.Logger,
 				     waitGroup *sync.WaitGroup,
-				     plan *watch.Plan) {
+				     plan *watch.Plan,
+				     exitChannel <-chan struct{}) {
 	waitGroup.Add(1)
 	defer waitGroup.Done()
 
-	err := plan.RunWithClientAndHclog(agent.SAConsulClient, logger)
-	if  err != nil {
-		logger.Error("failed to run plan", "error", err, "service",
-			     agent.SAServiceName)
+	strategy := retry.TimeoutRetryStrategy{PollingInterval: PlanRetryInterval}
+	err := strategy.Run(retry.RetryableFunc(func() (bool, error) {
+		tryErr := plan.RunWithClientAndHclog(agent.SAConsulClient, logger)
+		if tryErr != nil {
+			metrics.IncrCounter([]string{"agent", "plan", "handler", "errors"}, 1)
+		}
+		return tryErr != nil, tryErr
+	}), exitChannel)
+	if err != nil {
+		logger.Error("failed to run plan", "error", err)
 	}
 }
 
@@ -495,12 +834,12 @@ func (agent *ServiceAgent) SAMonitorService(logger log.Logger,
 
 	plan, err := watch.Parse(params)
 	if err != nil {
-		logger.Error("failed to parse param of watch", "error", err,
-			     "service", agent.SAServiceName)
+		logger.Error("failed to parse param of watch", "error", err)
 		return
 	}
 
 	newConf := agent.SARuntimeConfig
+	currentBackendName := newConf.RCBackend
 	plan.Handler = func(idx uint64, raw interface{}) {
 		var value *api.KVPair
 
@@ -514,18 +853,26 @@ func (agent *ServiceAgent) SAMonitorService(logger log.Logger,
 
 			err = yaml.Unmarshal(value.Value, &newConf)
 			if err != nil {
-				logger.Error("failed to unmarshal", "error", err,
-					     "service", agent.SAServiceName)
+				logger.Error("failed to unmarshal", "error", err)
 				return // ignore
 			}
 			agent.SARuntimeConfig = newConf
 			logger.Info("change of config", "enable autostart",
 				    newConf.RCAutostartEnabled, "service",
 				    agent.SAServiceName)
+
+			if newConf.RCBackend != "" && newConf.RCBackend != currentBackendName {
+				logger.Info("backend changed by reload, swapping live backend",
+					    "old", currentBackendName, "new", newConf.RCBackend,
+					    "service", agent.SAServiceName)
+				agent.SABackendConfig.Name = newConf.RCBackend
+				agent.SABackend = newServiceBackend(agent.SABackendConfig)
+				currentBackendName = newConf.RCBackend
+			}
 		}
 	}
 
-	go agent.SAPlanRun(logger, waitGroup, plan)
+	go agent.SAPlanRun(logger, waitGroup, plan, exitChannel)
 
 	for {
 		exiting := agent.SAMonitorServiceOnce(logger, waitGroup, exitChannel)
@@ -556,11 +903,44 @@ type HostAgent struct {
 	HAConfigKey string
 	HARuntimeConfig RuntimeConfig
 	HAHostStatus HostStatus
+	// HABackendConfig is the backend selection/SSH credentials HABackend
+	// was last built from, kept so a later RCBackend reload can rebuild
+	// an SSHBackend with the same credentials.
+	HABackendConfig BackendConfig
+	// HABackend performs the start/stop/ping operations, selected by
+	// the --backend flag / RCBackend runtime config.
+	HABackend HostBackend
+	// HAHooks renders and runs the on_leader_lost hook configured for
+	// this host.
+	HAHooks *hooks.Runner
+	// HAHostHooks are the hooks configured for this host in
+	// ClownfishConfig.CCHooks.
+	HAHostHooks hooks.HostHooks
+	// HALogger is the root logger's "host" sub-logger, pre-tagged with
+	// this agent's hostname so callers don't have to.
+	HALogger log.Logger
+
+	// HAExitChannel closes when either the process-wide exitChannel
+	// closes or HACancel is called, so this agent's goroutines can be
+	// stopped individually by a config reload that removes its host
+	// without affecting any other agent.
+	HAExitChannel <-chan struct{}
+	// HACancel stops this agent's goroutines without closing the
+	// process-wide exitChannel. Safe to call more than once.
+	HACancel func()
+
+	// HALeaderMutex guards HAIsLeader, which HAReconcile checks against
+	// Consul's view of HALockKey to catch drift.
+	HALeaderMutex sync.Mutex
+	HAIsLeader    bool
 }
 
-func CreateLustreHostAgents(logger log.Logger,
-			    consulConf *api.Config,
-			    config *ClownfishConfig) ([]*HostAgent, error) {
+// hostMonitorList computes the bounded set of peer hosts this node
+// should monitor: up to CLF_MAX_WATCH_HOST hosts following the local
+// host in sorted order, wrapping around to the start of the list.
+// Factored out of CreateLustreHostAgents so handleConfigReload can
+// recompute it against a reloaded config to find added/removed hosts.
+func hostMonitorList(logger log.Logger, config *ClownfishConfig) (SSHHostList, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		logger.Error("failed to get local hostname", "error", err)
@@ -619,65 +999,124 @@ func CreateLustreHostAgents(logger log.Logger,
 	}
 
 	sort.Sort(monitorList)
+	return monitorList, nil
+}
+
+func CreateLustreHostAgents(logger log.Logger,
+			    consulConf *api.Config,
+			    config *ClownfishConfig,
+			    backendConf BackendConfig,
+			    hookRunner *hooks.Runner,
+			    exitChannel <-chan struct{}) ([]*HostAgent, error) {
+	monitorList, err := hostMonitorList(logger, config)
+	if err != nil {
+		return nil, err
+	}
 
 	var agents []*HostAgent
 	for _, sshHost := range monitorList {
-		hostname := sshHost.SSHHostName
-
-		client, err := api.NewClient(consulConf)
+		agent, err := createHostAgent(logger, consulConf, config, backendConf, hookRunner,
+					      sshHost, exitChannel)
 		if err != nil {
-			logger.Error("failed to create Consul client",
-				     "error", err,
-				     "hostname", hostname)
 			return nil, err
 		}
+		agents = append(agents, agent)
+	}
+	return agents, nil
+}
 
-		uuid, err := uuid.GenerateUUID()
-		if err != nil {
-			logger.Error("failed to generate uuid", "error", err,
-				     "hostname", hostname)
-			return nil, err
-		}
+// createHostAgent builds a single HostAgent for sshHost: a Consul client,
+// the coordinating lock, and the runtime/hooks config it starts with.
+// exitChannel is the process-wide exit channel; the agent's own
+// HAExitChannel/HACancel are derived from it so a later config reload can
+// stop this agent alone. Factored out of CreateLustreHostAgents so
+// handleConfigReload can spawn an agent for a host added to the config
+// without restarting the process.
+func createHostAgent(logger log.Logger, consulConf *api.Config,
+		      config *ClownfishConfig, backendConf BackendConfig,
+		      hookRunner *hooks.Runner, sshHost SSHHost,
+		      exitChannel <-chan struct{}) (*HostAgent, error) {
+	hostname := sshHost.SSHHostName
+
+	startupRetry := retry.TimeoutRetryStrategy{
+		Timeout:         StartupRetryTimeout,
+		PollingInterval: StartupRetryInterval,
+	}
 
-		sessionTTL := fmt.Sprintf("%ds", SessionTTLSeconds)
-		waitTime := SessionTTLSeconds * time.Second
+	var client *api.Client
+	err := startupRetry.Run(retry.RetryableFunc(func() (bool, error) {
+		var tryErr error
+		client, tryErr = api.NewClient(consulConf)
+		return tryErr != nil, tryErr
+	}), nil)
+	if err != nil {
+		logger.Error("failed to create Consul client after retrying",
+			     "error", err)
+		return nil, err
+	}
 
-		lockKey := CLF_CONSUL_HOST_PATH + "/" + hostname + "/" + CLF_CONSUL_LOCK_KEY
-		opts := &api.LockOptions{
-			Key:            lockKey,
-			Value:          []byte(uuid),
-			SessionName:    "Clownfish host Lock",
-			MonitorRetries: 5,
-			SessionTTL:     sessionTTL,
-		}
-		//opts.LockWaitTime = waitTime
+	uuid, err := uuid.GenerateUUID()
+	if err != nil {
+		logger.Error("failed to generate uuid", "error", err)
+		return nil, err
+	}
 
-		lock, err := client.LockOpts(opts)
-		if err != nil {
-			logger.Error("failed to create lock", "error", err,
-				     "hostname", hostname)
-			return nil, err
-		}
+	sessionTTL := fmt.Sprintf("%ds", SessionTTLSeconds)
+	waitTime := SessionTTLSeconds * time.Second
 
-		configKey := CLF_CONSUL_HOST_PATH + "/" + hostname + "/" + CLF_CONSUL_CONFIG_KEY
-		runtimeConf := RuntimeConfig {
-			RCAutostartEnabled: false,
-		}
+	lockKey := CLF_CONSUL_HOST_PATH + "/" + hostname + "/" + CLF_CONSUL_LOCK_KEY
+	opts := &api.LockOptions{
+		Key:            lockKey,
+		Value:          []byte(uuid),
+		SessionName:    "Clownfish host Lock",
+		MonitorRetries: 5,
+		SessionTTL:     sessionTTL,
+	}
+	//opts.LockWaitTime = waitTime
+
+	var lock *api.Lock
+	err = startupRetry.Run(retry.RetryableFunc(func() (bool, error) {
+		var tryErr error
+		lock, tryErr = client.LockOpts(opts)
+		return tryErr != nil, tryErr
+	}), nil)
+	if err != nil {
+		logger.Error("failed to create lock after retrying", "error", err)
+		return nil, err
+	}
 
-		agent := HostAgent {
-			HASSHHost: sshHost,
-			HASessionTTL: waitTime,
-			HASessionTTLSeconds: SessionTTLSeconds,
-			HALockKey: lockKey,
-			HAConsulClient: client,
-			HAUuid: uuid,
-			HAConsulLock: lock,
-			HAConfigKey: configKey,
-			HARuntimeConfig: runtimeConf,
-		}
-		agents = append(agents, &agent)
+	configKey := CLF_CONSUL_HOST_PATH + "/" + hostname + "/" + CLF_CONSUL_CONFIG_KEY
+	runtimeConf := defaultRuntimeConfig(backendConf.Name)
+	haExitChannel, haCancel := newAgentExitChannel(exitChannel)
+
+	agent := HostAgent {
+		HASSHHost: sshHost,
+		HASessionTTL: waitTime,
+		HASessionTTLSeconds: SessionTTLSeconds,
+		HALockKey: lockKey,
+		HAConsulClient: client,
+		HAUuid: uuid,
+		HAConsulLock: lock,
+		HAConfigKey: configKey,
+		HARuntimeConfig: runtimeConf,
+		HABackendConfig: backendConf,
+		HABackend: newHostBackend(backendConf),
+		HAHooks: hookRunner,
+		HAHostHooks: config.CCHooks.Hosts[hostname],
+		HALogger: logger.Named("host").With("hostname", hostname),
+		HAExitChannel: haExitChannel,
+		HACancel: haCancel,
 	}
-	return agents, nil
+	watchHostHooks(hookRunner, hostname, agent.HAHostHooks, runtimeConf)
+	return &agent, nil
+}
+
+// watchHostHooks is watchServiceHooks' HostAgent equivalent, for the
+// single on_leader_lost hook point a host has.
+func watchHostHooks(hookRunner *hooks.Runner, hostname string,
+		     hostHooks hooks.HostHooks, runtimeConf RuntimeConfig) {
+	data := hooks.TemplateData{Host: hostname, Runtime: runtimeConf}
+	hookRunner.WatchHookKeys("host/"+hostname+"/on_leader_lost", hostHooks.OnLeaderLost, data)
 }
 
 // Read the lock value if lock is held. Return error if lock is not held.
@@ -736,10 +1175,15 @@ func (agent *HostAgent) HAGetLeaderUUIDWait(exitChannel <-chan struct{}) (string
 // SAAcquireLock blocks until the lock is acquired, returning the leaderLostCh
 func (agent *HostAgent) HAAcquireLock(logger log.Logger,
 				      exitChannel <-chan struct{}) (<-chan struct{}) {
+	startTime := time.Now()
 	for {
 		// Attempt lock acquisition
 		leaderLostCh, err := agent.HAConsulLock.Lock(exitChannel)
 		if err == nil {
+			metrics.MeasureSince([]string{"agent", "lock", "acquire", "duration"}, startTime)
+			metrics.IncrCounter([]string{"agent", "session", "renewals"}, 1)
+			metrics.SetGaugeWithLabels([]string{"agent", "lock", "holder"}, 1,
+						   []metrics.Label{{Name: "hostname", Value: agent.HASSHHost.SSHHostName}})
 			return leaderLostCh
 		}
 
@@ -754,6 +1198,36 @@ func (agent *HostAgent) HAAcquireLock(logger log.Logger,
 	}
 }
 
+// HARefreshSessionTTL is SARefreshSessionTTL's HostAgent equivalent: it
+// rebuilds HAConsulLock with RCSessionTTLSeconds when it has changed,
+// and must only be called between lock holds.
+func (agent *HostAgent) HARefreshSessionTTL(logger log.Logger) {
+	wanted := agent.HARuntimeConfig.RCSessionTTLSeconds
+	if wanted <= 0 || wanted == agent.HASessionTTLSeconds {
+		return
+	}
+
+	opts := &api.LockOptions{
+		Key:            agent.HALockKey,
+		Value:          []byte(agent.HAUuid),
+		SessionName:    "Clownfish host Lock",
+		MonitorRetries: 5,
+		SessionTTL:     fmt.Sprintf("%ds", wanted),
+	}
+	lock, err := agent.HAConsulClient.LockOpts(opts)
+	if err != nil {
+		logger.Error("failed to rebuild lock with new session TTL", "error", err,
+			     "session_ttl_seconds", wanted)
+		return
+	}
+
+	logger.Info("session TTL changed by reload, rebuilding lock",
+		    "old", agent.HASessionTTLSeconds, "new", wanted)
+	agent.HAConsulLock = lock
+	agent.HASessionTTLSeconds = wanted
+	agent.HASessionTTL = time.Duration(wanted) * time.Second
+}
+
 func (agent *HostAgent) HAMaintainHost(logger log.Logger,
 				       waitGroup *sync.WaitGroup,
 				       exitChannel <-chan struct{}) {
@@ -761,8 +1235,6 @@ func (agent *HostAgent) HAMaintainHost(logger log.Logger,
 	defer waitGroup.Done()
 
 	hostname := agent.HASSHHost.SSHHostName
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
 
 	status := HSUnknown
 	agent.HAHostStatus = status
@@ -770,49 +1242,45 @@ func (agent *HostAgent) HAMaintainHost(logger log.Logger,
 	var autostartEnabled bool
 	var newStatus HostStatus
 	first := true
+	retryStrategy := NewTimeoutRetryStrategy(agent.HARuntimeConfig)
 	for {
+		retryStrategy.applyTuning(agent.HARuntimeConfig)
 		autostartEnabled = agent.HARuntimeConfig.RCAutostartEnabled
 		if first || oldAutostartEnabled != autostartEnabled {
 			if autostartEnabled {
-				logger.Info("auotostart is enabled", "hostname", hostname)
+				logger.Info("auotostart is enabled")
 			} else {
-				logger.Info("auotostart is disabled", "hostname", hostname)
+				logger.Info("auotostart is disabled")
 			}
 			first = false
 		}
 		oldAutostartEnabled = autostartEnabled
-		if autostartEnabled {
+		if autostartEnabled && !retryStrategy.CircuitOpen() {
 			if status == HSUnknown || status == HSStartFailed {
-				logger.Info("starting host", "hostname", hostname)
+				logger.Info("starting host")
 			}
-			cmd := exec.Command("clownf", "host", "start", hostname)
-			stdout.Reset()
-			stderr.Reset()
-			cmd.Stdout = &stdout
-			cmd.Stderr = &stderr
 			startTime := time.Now()
-			err := cmd.Run()
+			stdoutRaw, stderrRaw, err := agent.HABackend.Start(hostname)
 			duration := int(time.Since(startTime).Seconds())
-			stdoutString := stdout.String()
-			stdoutString = strings.Replace(stdoutString, "\n", "\\n", -1)
-			stderrString := stderr.String()
-			stderrString = strings.Replace(stderrString, "\n", "\\n", -1)
+			stdoutString := strings.Replace(stdoutRaw, "\n", "\\n", -1)
+			stderrString := strings.Replace(stderrRaw, "\n", "\\n", -1)
 
 			if err != nil {
 				logger.Error("failed to start host",
-					     "hostname", hostname,
 					     "error", err,
 					     "stdout", stdoutString,
 					     "stderr", stderrString,
 					     "duration", duration)
 				newStatus = HSStartFailed
+				retryStrategy.RecordFailure()
 			} else {
 				newStatus = HSStarted
+				retryStrategy.RecordSuccess()
 			}
 
+			metricsHostStatus.WithLabelValues(hostname).Set(hostStatusMetricValue(newStatus))
 			if status != newStatus {
-				logger.Info("status change of host",
-					    "hostname", hostname, "old",
+				logger.Info("status change of host", "old",
 					    status, "new", newStatus,
 					    "stdout", stdoutString,
 					    "stderr", stderrString,
@@ -820,20 +1288,20 @@ func (agent *HostAgent) HAMaintainHost(logger log.Logger,
 				status = newStatus
 				agent.HAHostStatus = newStatus
 			} else if (newStatus == HSStarted &&
-				   stdout.String() != CLF_MSG_ALREADY_STARTED) {
+				   stdoutRaw != CLF_MSG_ALREADY_STARTED) {
 				logger.Info("started host with stale status of up",
-					    "hostname", hostname,
 					    "stdout", stdoutString,
 					    "stderr", stderrString,
 					    "duration", duration)
 			}
+		} else if autostartEnabled {
+			logger.Info("circuit open, suppressing start attempts")
 		}
 
 		select {
-		case <-time.After(agent.HASessionTTL):
+		case <-time.After(retryStrategy.NextInterval()):
 		case <-exitChannel:
-			logger.Error("exiting from maintaining host",
-				     "hostname", hostname)
+			logger.Error("exiting from maintaining host")
 			return
 		}
 	}
@@ -843,12 +1311,12 @@ func (agent *HostAgent) HAMonitorHostOnce(logger log.Logger,
 					  waitGroup *sync.WaitGroup,
 					  exitChannel <-chan struct{}) (bool) {
 	var err error
+	agent.HARefreshSessionTTL(logger)
 	currentLeader, exiting := agent.HAGetLeaderUUIDWait(exitChannel)
 
 	hostname := agent.HASSHHost.SSHHostName
 	if exiting {
-		logger.Info("exiting when trying to get the leader uuid",
-			    "hostname", hostname)
+		logger.Info("exiting when trying to get the leader uuid")
 		return true
 	}
 
@@ -856,44 +1324,56 @@ func (agent *HostAgent) HAMonitorHostOnce(logger log.Logger,
 	// Note that the currentLeader could be empty string
 	if currentLeader != agent.HAUuid {
 		if currentLeader == "" {
-			logger.Info("not able to get the current leader for a long time",
-				    "hostname", hostname)
+			logger.Info("not able to get the current leader for a long time")
 		} else {
-			logger.Info("the current leader is someone else",
-				    "hostname", hostname)
+			logger.Info("the current leader is someone else")
 		}
 	}
 
-	logger.Info("trying to get the leadership lock",
-		    "hostname", hostname)
+	logger.Info("trying to get the leadership lock")
 	leaderLostCh := agent.HAAcquireLock(logger, exitChannel)
 	if leaderLostCh == nil {
-		logger.Info("exiting when trying to get the leadership lock",
-			    "hostname", hostname)
+		logger.Info("exiting when trying to get the leadership lock")
 		return true
 	}
 
-	logger.Info("got the leadership lock", "hostname", hostname)
+	logger.Info("got the leadership lock")
+	agent.HALeaderMutex.Lock()
+	agent.HAIsLeader = true
+	agent.HALeaderMutex.Unlock()
 	go agent.HAMaintainHost(logger, waitGroup, exitChannel)
 
 	// Monitor a loss of leadership
 	select {
 	case <-leaderLostCh:
-		logger.Info("lost the leadership",
-			    "hostname", hostname)
+		logger.Info("lost the leadership")
+		agent.HALeaderMutex.Lock()
+		agent.HAIsLeader = false
+		agent.HALeaderMutex.Unlock()
+		metrics.SetGaugeWithLabels([]string{"agent", "lock", "holder"}, 0,
+					   []metrics.Label{{Name: "hostname", Value: agent.HASSHHost.SSHHostName}})
+		agent.HAHooks.Invoke("host/"+hostname+"/on_leader_lost",
+				     agent.HAHostHooks.OnLeaderLost,
+				     hooks.TemplateData{Host: hostname, Runtime: agent.HARuntimeConfig})
 		err = agent.HAConsulLock.Unlock()
 		if err != nil {
 			logger.Error("failed to release the leadership lock",
-				     "error", err, "hostname", hostname)
+				     "error", err)
 		}
 		return false
 	case <-exitChannel:
-		logger.Info("exiting while holding the leadership lock",
-			    "hostname", hostname)
+		logger.Info("exiting while holding the leadership lock")
+		agent.HALeaderMutex.Lock()
+		agent.HAIsLeader = false
+		agent.HALeaderMutex.Unlock()
 		err = agent.HAConsulLock.Unlock()
 		if err != nil {
 			logger.Error("failed to release the leadership lock",
-				     "error", err, "hostname", hostname)
+				     "error", err)
+		}
+		if err := agent.HAConsulLock.Destroy(); err != nil {
+			logger.Error("failed to destroy the leadership lock's session",
+				     "error", err)
 		}
 		return true
 	}
@@ -901,15 +1381,21 @@ func (agent *HostAgent) HAMonitorHostOnce(logger log.Logger,
 
 func (agent *HostAgent) HAPlanRun(logger log.Logger,
 				  waitGroup *sync.WaitGroup,
-				  plan *watch.Plan) {
+				  plan *watch.Plan,
+				  exitChannel <-chan struct{}) {
 	waitGroup.Add(1)
 	defer waitGroup.Done()
 
-	hostname := agent.HASSHHost.SSHHostName
-	err := plan.RunWithClientAndHclog(agent.HAConsulClient, logger)
-	if  err != nil {
-		logger.Error("failed to run plan", "error", err, "hostname",
-			     hostname)
+	strategy := retry.TimeoutRetryStrategy{PollingInterval: PlanRetryInterval}
+	err := strategy.Run(retry.RetryableFunc(func() (bool, error) {
+		tryErr := plan.RunWithClientAndHclog(agent.HAConsulClient, logger)
+		if tryErr != nil {
+			metrics.IncrCounter([]string{"agent", "plan", "handler", "errors"}, 1)
+		}
+		return tryErr != nil, tryErr
+	}), exitChannel)
+	if err != nil {
+		logger.Error("failed to run plan", "error", err)
 	}
 }
 
@@ -925,12 +1411,12 @@ func (agent *HostAgent) HAMonitorHost(logger log.Logger,
 
 	plan, err := watch.Parse(params)
 	if err != nil {
-		logger.Error("failed to parse param of watch", "error", err,
-			     "hostname", hostname)
+		logger.Error("failed to parse param of watch", "error", err)
 		return
 	}
 
 	newConf := agent.HARuntimeConfig
+	currentBackendName := newConf.RCBackend
 	plan.Handler = func(idx uint64, raw interface{}) {
 		var value *api.KVPair
 
@@ -944,18 +1430,26 @@ func (agent *HostAgent) HAMonitorHost(logger log.Logger,
 
 			err = yaml.Unmarshal(value.Value, &newConf)
 			if err != nil {
-				logger.Error("failed to unmarshal", "error", err,
-					     "hostname", hostname)
+				logger.Error("failed to unmarshal", "error", err)
 				return // ignore
 			}
 			agent.HARuntimeConfig = newConf
 			logger.Info("change of config", "enable autostart",
 				    newConf.RCAutostartEnabled, "hostname",
 				    hostname)
+
+			if newConf.RCBackend != "" && newConf.RCBackend != currentBackendName {
+				logger.Info("backend changed by reload, swapping live backend",
+					    "old", currentBackendName, "new", newConf.RCBackend,
+					    "hostname", hostname)
+				agent.HABackendConfig.Name = newConf.RCBackend
+				agent.HABackend = newHostBackend(agent.HABackendConfig)
+				currentBackendName = newConf.RCBackend
+			}
 		}
 	}
 
-	go agent.HAPlanRun(logger, waitGroup, plan)
+	go agent.HAPlanRun(logger, waitGroup, plan, exitChannel)
 
 	for {
 		exiting := agent.HAMonitorHostOnce(logger, waitGroup, exitChannel)
@@ -968,72 +1462,141 @@ func (agent *HostAgent) HAMonitorHost(logger log.Logger,
 
 func CreateServiceAgents(logger log.Logger,
 			 consulConf *api.Config,
-			 clownfishConfig *ClownfishConfig) ([]*ServiceAgent, error) {
-	localService, err := filterLocalServices(logger, clownfishConfig)
+			 clownfishConfig *ClownfishConfig,
+			 backendConf BackendConfig,
+			 hookRunner *hooks.Runner,
+			 exitChannel <-chan struct{}) ([]*ServiceAgent, error) {
+	startupRetry := retry.TimeoutRetryStrategy{
+		Timeout:         StartupRetryTimeout,
+		PollingInterval: StartupRetryInterval,
+	}
+
+	var localService *LocalServiceInstances
+	err := startupRetry.Run(retry.RetryableFunc(func() (bool, error) {
+		var tryErr error
+		localService, tryErr = filterLocalServices(logger, clownfishConfig)
+		return tryErr != nil, tryErr
+	}), nil)
 	if err != nil {
-		logger.Error("failed to filter local services")
+		logger.Error("failed to filter local services after retrying", "error", err)
 		return nil, err
 	}
 	logger.Debug("got local service", "service", localService)
 
 	var agents []*ServiceAgent
 	for _, serviceInstance := range localService.LSServiceInstances {
-		service := serviceInstance.LSService
-		serviceName := service.LSServiceName
-
-		client, err := api.NewClient(consulConf)
+		agent, err := createServiceAgent(logger, consulConf, clownfishConfig, backendConf,
+						  hookRunner, serviceInstance.LSService, exitChannel)
 		if err != nil {
-			logger.Error("failed to create Consul client",
-				     "error", err, "service", serviceName)
 			return nil, err
 		}
+		agents = append(agents, agent)
+	}
+	return agents, nil
+}
 
-		uuid, err := uuid.GenerateUUID()
-		if err != nil {
-			logger.Error("failed to generate uuid", "error", err,
-				     "service", serviceName)
-			return nil, err
-		}
+// createServiceAgent builds a single ServiceAgent for lustreService: a
+// Consul client, the coordinating lock, and the runtime/hooks config it
+// starts with. exitChannel is the process-wide exit channel; the agent's
+// own SAExitChannel/SACancel are derived from it so a later config
+// reload can stop this agent alone. Factored out of CreateServiceAgents
+// so handleConfigReload can spawn an agent for a service added to the
+// config without restarting the process.
+func createServiceAgent(logger log.Logger, consulConf *api.Config,
+			 clownfishConfig *ClownfishConfig, backendConf BackendConfig,
+			 hookRunner *hooks.Runner, lustreService *LustreService,
+			 exitChannel <-chan struct{}) (*ServiceAgent, error) {
+	serviceName := lustreService.LSServiceName
+
+	startupRetry := retry.TimeoutRetryStrategy{
+		Timeout:         StartupRetryTimeout,
+		PollingInterval: StartupRetryInterval,
+	}
 
-		sessionTTL := fmt.Sprintf("%ds", SessionTTLSeconds)
-		waitTime := SessionTTLSeconds * time.Second
+	var client *api.Client
+	err := startupRetry.Run(retry.RetryableFunc(func() (bool, error) {
+		var tryErr error
+		client, tryErr = api.NewClient(consulConf)
+		return tryErr != nil, tryErr
+	}), nil)
+	if err != nil {
+		logger.Error("failed to create Consul client after retrying",
+			     "error", err, "service", serviceName)
+		return nil, err
+	}
 
-		lockKey := CLF_CONSUL_SERVICE_PATH + "/" + serviceName + "/" + CLF_CONSUL_LOCK_KEY
-		opts := &api.LockOptions{
-			Key:            lockKey,
-			Value:          []byte(uuid),
-			SessionName:    "Clownfish service Lock",
-			MonitorRetries: 5,
-			SessionTTL:     sessionTTL,
-		}
-		//opts.LockWaitTime = waitTime
+	uuid, err := uuid.GenerateUUID()
+	if err != nil {
+		logger.Error("failed to generate uuid", "error", err,
+			     "service", serviceName)
+		return nil, err
+	}
 
-		lock, err := client.LockOpts(opts)
-		if err != nil {
-			logger.Error("failed to create lock", "error", err,
-				     "service", serviceName)
-			return nil, err
-		}
+	sessionTTL := fmt.Sprintf("%ds", SessionTTLSeconds)
+	waitTime := SessionTTLSeconds * time.Second
 
-		configKey := CLF_CONSUL_SERVICE_PATH + "/" + serviceName + "/" + CLF_CONSUL_CONFIG_KEY
-		runtimeConf := RuntimeConfig {
-			RCAutostartEnabled: false,
-		}
-		agent := ServiceAgent {
-			SAServiceStatus: SSUnknown,
-			SAServiceName: serviceName,
-			SASessionTTL: waitTime,
-			SASessionTTLSeconds: SessionTTLSeconds,
-			SALockKey: lockKey,
-			SAConfigKey: configKey,
-			SAConsulClient: client,
-			SAUuid: uuid,
-			SAConsulLock: lock,
-			SARuntimeConfig: runtimeConf,
-		}
-		agents = append(agents, &agent)
+	lockKey := CLF_CONSUL_SERVICE_PATH + "/" + serviceName + "/" + CLF_CONSUL_LOCK_KEY
+	opts := &api.LockOptions{
+		Key:            lockKey,
+		Value:          []byte(uuid),
+		SessionName:    "Clownfish service Lock",
+		MonitorRetries: 5,
+		SessionTTL:     sessionTTL,
 	}
-	return agents, nil
+	//opts.LockWaitTime = waitTime
+
+	var lock *api.Lock
+	err = startupRetry.Run(retry.RetryableFunc(func() (bool, error) {
+		var tryErr error
+		lock, tryErr = client.LockOpts(opts)
+		return tryErr != nil, tryErr
+	}), nil)
+	if err != nil {
+		logger.Error("failed to create lock after retrying", "error", err,
+			     "service", serviceName)
+		return nil, err
+	}
+
+	configKey := CLF_CONSUL_SERVICE_PATH + "/" + serviceName + "/" + CLF_CONSUL_CONFIG_KEY
+	runtimeConf := defaultRuntimeConfig(backendConf.Name)
+	saExitChannel, saCancel := newAgentExitChannel(exitChannel)
+	agent := ServiceAgent {
+		SAServiceStatus: SSUnknown,
+		SAServiceName: serviceName,
+		SAFsname: lustreService.LSFsname,
+		SARole: lustreService.LSRole,
+		SASessionTTL: waitTime,
+		SASessionTTLSeconds: SessionTTLSeconds,
+		SALockKey: lockKey,
+		SAConfigKey: configKey,
+		SAConsulClient: client,
+		SAUuid: uuid,
+		SAConsulLock: lock,
+		SARuntimeConfig: runtimeConf,
+		SABackendConfig: backendConf,
+		SABackend: newServiceBackend(backendConf),
+		SAHooks: hookRunner,
+		SAServiceHooks: clownfishConfig.CCHooks.Services[serviceName],
+		SALogger: logger.Named("service").With("service", serviceName),
+		SAExitChannel: saExitChannel,
+		SACancel: saCancel,
+	}
+	watchServiceHooks(hookRunner, serviceName, agent.SAServiceHooks, runtimeConf)
+	return &agent, nil
+}
+
+// watchServiceHooks starts a Consul KV watch for every key referenced by
+// this service's hooks, so they re-render and re-run when a referenced
+// value changes instead of only ever running from the explicit Invoke
+// call sites in SAMaintainService/SAMonitorServiceOnce/SAPreReleaseHook.
+func watchServiceHooks(hookRunner *hooks.Runner, serviceName string,
+		       serviceHooks hooks.ServiceHooks, runtimeConf RuntimeConfig) {
+	data := hooks.TemplateData{Service: serviceName, Runtime: runtimeConf}
+	hookRunner.WatchHookKeys("service/"+serviceName+"/pre_mount", serviceHooks.PreMount, data)
+	hookRunner.WatchHookKeys("service/"+serviceName+"/post_mount", serviceHooks.PostMount, data)
+	hookRunner.WatchHookKeys("service/"+serviceName+"/pre_umount", serviceHooks.PreUmount, data)
+	hookRunner.WatchHookKeys("service/"+serviceName+"/on_status_change", serviceHooks.OnStatusChange, data)
+	hookRunner.WatchHookKeys("service/"+serviceName+"/on_leader_lost", serviceHooks.OnLeaderLost, data)
 }
 
 
@@ -1041,13 +1604,21 @@ func VersionCheckOnce(logger log.Logger) {
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 
-	cmd := exec.Command("clownf", "version_check", "--no_log_prefix")
-	stdout.Reset()
-	stderr.Reset()
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
 	startTime := time.Now()
-	err := cmd.Run()
+	versionCheckRetry := retry.TimeoutRetryStrategy{
+		Timeout:         VersionCheckRetryTimeout,
+		PollingInterval: VersionCheckRetryInterval,
+	}
+	err := versionCheckRetry.Run(retry.RetryableFunc(func() (bool, error) {
+		stdout.Reset()
+		stderr.Reset()
+		cmd := exec.Command("clownf", "version_check", "--no_log_prefix")
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		tryErr := cmd.Run()
+		return tryErr != nil, tryErr
+	}), nil)
+	metrics.MeasureSince([]string{"version_check", "duration"}, startTime)
 	duration := int(time.Since(startTime).Seconds())
 	stdoutString := stdout.String()
 	stderrString := stderr.String()
@@ -1101,9 +1672,18 @@ func VersionCheck(logger log.Logger, waitGroup *sync.WaitGroup,
 
 func main() {
 	addr := "127.0.0.1:8500"
-	logger := log.New(&log.LoggerOptions{
-		Name: "clownf_agent",
-	})
+	agentFlags := parseAgentFlags()
+	logger := newAgentLogger(agentFlags.Logger)
+	serveMetrics(logger, agentFlags.MetricsAddr)
+
+	if agentFlags.Backend.Name == "ssh" {
+		authMethods, err := loadSSHAuthMethods(agentFlags.Backend.SSHKeyFile)
+		if err != nil {
+			logger.Error("failed to load SSH key for --backend ssh", "error", err)
+			return
+		}
+		agentFlags.Backend.SSHAuthMethods = authMethods
+	}
 
 	clownfishConfig, err := loadConfig(logger)
 	if err != nil {
@@ -1111,6 +1691,11 @@ func main() {
 		return
 	}
 
+	if err := initTelemetry(logger, clownfishConfig.CCTelemetry); err != nil {
+		logger.Error("failed to init telemetry")
+		return
+	}
+
 	consulConf := api.DefaultConfig()
 	consulConf.Transport.MaxIdleConnsPerHost = 1
 	consulConf.Address = addr
@@ -1134,35 +1719,48 @@ func main() {
 		} // allow "unix:" or whatever else consul supports in the future
 	}
 
-	agents, err := CreateServiceAgents(logger, consulConf, clownfishConfig)
+	hookClient, err := api.NewClient(consulConf)
+	if err != nil {
+		logger.Error("failed to create Consul client for hooks", "error", err)
+		return
+	}
+	hookRunner := hooks.NewRunner(logger.Named("hooks"), hookClient, clownfishConfig.CCHooks)
+
+	exitChannel := make(chan struct{})
+	waitGroup := sync.WaitGroup{}
+
+	agents, err := CreateServiceAgents(logger, consulConf, clownfishConfig, agentFlags.Backend,
+					   hookRunner, exitChannel)
 	if err != nil {
 		logger.Error("failed to create service agents", "error", err)
 		return
 	}
 
-	hostAgents, err := CreateLustreHostAgents(logger, consulConf, clownfishConfig)
+	hostAgents, err := CreateLustreHostAgents(logger, consulConf, clownfishConfig, agentFlags.Backend,
+						   hookRunner, exitChannel)
 	if err != nil {
 		logger.Error("failed to create server agents", "error", err)
 		return
 	}
 
-	exitChannel := make(chan struct{})
-	waitGroup := sync.WaitGroup{}
-
-	go VersionCheck(logger, &waitGroup, exitChannel)
+	go VersionCheck(logger.Named("version_check"), &waitGroup, exitChannel)
 
 	for _, agent := range agents {
-		logger.Info("starting agent for Lustre service",
-			    "service_name", agent.SAServiceName)
-		go agent.SAMonitorService(logger, &waitGroup, exitChannel)
+		agent.SALogger.Info("starting agent for Lustre service")
+		go agent.SAMonitorService(agent.SALogger, &waitGroup, agent.SAExitChannel)
+		go agent.SAReconcile(agent.SALogger, &waitGroup, agent.SAExitChannel)
 	}
 
 	for _, hostAgent := range hostAgents {
-		logger.Info("starting agent for host", "hostname",
-			    hostAgent.HASSHHost.SSHHostName)
-		go hostAgent.HAMonitorHost(logger, &waitGroup, exitChannel)
+		hostAgent.HALogger.Info("starting agent for host")
+		go hostAgent.HAMonitorHost(hostAgent.HALogger, &waitGroup, hostAgent.HAExitChannel)
+		go hostAgent.HAReconcile(hostAgent.HALogger, &waitGroup, hostAgent.HAExitChannel)
 	}
 
+	configReloadCh := make(chan chan error)
+	go runConfigReloader(logger.Named("reload"), consulConf, agentFlags.Backend, hookRunner,
+			     &waitGroup, exitChannel, &agents, &hostAgents, configReloadCh)
+
 	signalChannel := make(chan os.Signal, 1)
 	signal.Notify(signalChannel)
 
@@ -1173,8 +1771,19 @@ func main() {
 			logger.Warn("quiting because of signal", "signal", signal)
 			break
 		}
+
+		if signal == syscall.SIGHUP {
+			logger.Info("reloading config because of SIGHUP")
+			respCh := make(chan error, 1)
+			configReloadCh <- respCh
+			if err := <-respCh; err != nil {
+				logger.Error("failed to reload config", "error", err)
+			} else {
+				logger.Info("reloaded config")
+			}
+		}
 	}
 
-	close(exitChannel)
-	waitGroup.Wait()
+	runGracefulShutdown(logger, exitChannel, &waitGroup, agents, hostAgents,
+			    agentFlags.GracefulTimeout)
 }
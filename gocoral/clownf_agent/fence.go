@@ -0,0 +1,208 @@
+// Author: Li Xi
+//
+// Fencing and cross-agent handoff for service failover. Before mounting,
+// a leader publishes a fence entry recording its uuid, host and the
+// Consul session holding its lock (no epoch counter is recorded), so a
+// successor can confirm the previous leader's claim has actually expired
+// instead of racing it to `clownf service mount`. On lock-loss the agent
+// runs a bounded pre-release umount through the service backend (with
+// ClownfBackend a plain `clownf service umount`, no force option) before
+// releasing the lock, and the new leader fires a Consul event so
+// operators/metrics can track failover MTTR.
+//
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+	"github.com/hashicorp/consul/api"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/LiXi-storage/barreleye/gocoral/hooks"
+)
+
+const (
+	// CLFFailoverEventName is the Consul user event fired whenever a new
+	// agent takes over leadership of a service from another agent.
+	CLFFailoverEventName = "barreleye.failover"
+
+	// SAFencePollInterval is how often SAWaitFenceClear re-checks
+	// whether a previous leader's fenced session has been invalidated.
+	SAFencePollInterval = time.Second
+)
+
+// FenceEntry is published to the service's fence KV path by whichever
+// agent currently holds (or last held) the leadership lock. FESession is
+// the Consul session that held SALockKey at publish time, so a successor
+// can authoritatively confirm the claim has actually been invalidated by
+// Consul rather than guessing from a wall-clock timestamp.
+type FenceEntry struct {
+	FEUuid    string `yaml:"uuid"`
+	FEHost    string `yaml:"host"`
+	FESession string `yaml:"session"`
+}
+
+// FailoverEvent is the payload fired on CLFFailoverEventName.
+type FailoverEvent struct {
+	FOService string `yaml:"service"`
+	FOOldUuid string `yaml:"old_uuid"`
+	FONewUuid string `yaml:"new_uuid"`
+}
+
+func (agent *ServiceAgent) SAFenceKey() string {
+	return CLF_CONSUL_SERVICE_PATH + "/" + agent.SAServiceName + "/" + CLF_CONSUL_FENCE_KEY
+}
+
+// SALockSessionID returns the Consul session currently holding
+// SALockKey ("" if the lock isn't held), so a fence entry can be tied to
+// an authoritative, checkable session instead of a wall-clock timestamp.
+func (agent *ServiceAgent) SALockSessionID() (string, error) {
+	kv := agent.SAConsulClient.KV()
+	pair, _, err := kv.Get(agent.SALockKey, &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return "", err
+	}
+	if pair == nil {
+		return "", nil
+	}
+	return pair.Session, nil
+}
+
+// SAPublishFence records that this agent, under the Consul session
+// currently holding its leadership lock, is about to mount the service,
+// so a successor can confirm that session (rather than trusting a
+// wall-clock epoch) before assuming the claim is stale.
+func (agent *ServiceAgent) SAPublishFence(logger log.Logger, hostname string) {
+	sessionID, err := agent.SALockSessionID()
+	if err != nil {
+		logger.Error("failed to look up the leadership lock's session", "error", err)
+		return
+	}
+
+	entry := FenceEntry{
+		FEUuid:    agent.SAUuid,
+		FEHost:    hostname,
+		FESession: sessionID,
+	}
+	data, err := yaml.Marshal(&entry)
+	if err != nil {
+		logger.Error("failed to marshal fence entry", "error", err)
+		return
+	}
+
+	kv := agent.SAConsulClient.KV()
+	_, err = kv.Put(&api.KVPair{Key: agent.SAFenceKey(), Value: data}, nil)
+	if err != nil {
+		logger.Error("failed to publish fence entry", "error", err)
+	}
+}
+
+// SAWaitFenceClear blocks until the fence entry left by a previous
+// leader is confirmed stale: its FESession no longer exists in Consul.
+// This is an authoritative check against Consul's session state rather
+// than a cross-host wall-clock comparison, which clock skew between
+// agents could make either unsafe or needlessly slow. Returns true if
+// exitChannel closed first.
+func (agent *ServiceAgent) SAWaitFenceClear(logger log.Logger, exitChannel <-chan struct{}) bool {
+	key := agent.SAFenceKey()
+	for {
+		kv := agent.SAConsulClient.KV()
+		pair, _, err := kv.Get(key, &api.QueryOptions{RequireConsistent: true})
+		if err != nil {
+			logger.Warn("failed to read previous fence entry, retrying", "error", err)
+			select {
+			case <-time.After(SAFencePollInterval):
+				continue
+			case <-exitChannel:
+				return true
+			}
+		}
+		if pair == nil {
+			return false
+		}
+
+		var entry FenceEntry
+		if err := yaml.Unmarshal(pair.Value, &entry); err != nil || entry.FEUuid == agent.SAUuid {
+			return false
+		}
+
+		if entry.FESession == "" {
+			return false
+		}
+
+		session, _, err := agent.SAConsulClient.Session().Info(entry.FESession,
+									&api.QueryOptions{RequireConsistent: true})
+		if err != nil {
+			logger.Warn("failed to check previous fence entry's session, retrying",
+				    "error", err)
+		} else if session == nil {
+			return false
+		} else {
+			logger.Info("waiting for previous fence entry's session to be invalidated by Consul",
+				    "session", entry.FESession)
+		}
+		select {
+		case <-time.After(SAFencePollInterval):
+		case <-exitChannel:
+			return true
+		}
+	}
+}
+
+// SAPreReleaseHook invokes the pre_umount hook, then runs a bounded
+// umount through agent.SABackend before the lock is released on a loss
+// of leadership, so the backing device is unmounted before a successor
+// can fence past our (stale) claim. Going through SABackend (rather than
+// shelling out to clownf directly) keeps this working under --backend
+// ssh/mock. The deadline is kept shorter than the session TTL so it
+// can't itself stall failover.
+func (agent *ServiceAgent) SAPreReleaseHook(logger log.Logger) {
+	deadline := time.Duration(agent.SASessionTTLSeconds-2) * time.Second
+	if deadline <= 0 {
+		deadline = time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Error("failed to get local hostname", "error", err)
+		return
+	}
+
+	agent.SAHooks.Invoke("service/"+agent.SAServiceName+"/pre_umount",
+			     agent.SAServiceHooks.PreUmount,
+			     hooks.TemplateData{Service: agent.SAServiceName, Runtime: agent.SARuntimeConfig})
+
+	stdout, stderr, err := agent.SABackend.Umount(ctx, hostname, agent.SAServiceName)
+	if err != nil {
+		logger.Error("pre-release hook failed",
+			     "error", err, "stdout", stdout, "stderr", stderr)
+	}
+}
+
+// SAFireFailoverEvent notifies operators (and the metrics subsystem) of
+// a leadership handoff for MTTR tracking.
+func (agent *ServiceAgent) SAFireFailoverEvent(logger log.Logger, oldUuid string) {
+	event := FailoverEvent{
+		FOService: agent.SAServiceName,
+		FOOldUuid: oldUuid,
+		FONewUuid: agent.SAUuid,
+	}
+	payload, err := yaml.Marshal(&event)
+	if err != nil {
+		logger.Error("failed to marshal failover event", "error", err)
+		return
+	}
+
+	_, _, err = agent.SAConsulClient.Event().Fire(&api.UserEvent{
+		Name:    CLFFailoverEventName,
+		Payload: payload,
+	}, nil)
+	if err != nil {
+		logger.Error("failed to fire failover event", "error", err)
+	}
+}
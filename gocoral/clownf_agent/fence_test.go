@@ -0,0 +1,174 @@
+// Author: Li Xi
+//
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/sdk/testutil"
+	log "github.com/hashicorp/go-hclog"
+)
+
+// requireConsulBinary skips the test when the consul binary isn't on
+// PATH, since testutil.NewTestServerConfigT shells out to it to stand up
+// an ephemeral test server.
+func requireConsulBinary(t *testing.T) {
+	if _, err := exec.LookPath("consul"); err != nil {
+		t.Skip("consul binary not found on PATH, skipping fence integration test")
+	}
+}
+
+// TestSAWaitFenceClearWaitsForFenceExpiry simulates a leader that
+// publishes a fence entry tied to the Consul session holding its
+// leadership lock, then crashes mid-mount (the session is never
+// destroyed by the leader itself): a successor agent with a different
+// SAUuid must block in SAWaitFenceClear until Consul actually
+// invalidates that session, rather than racing it to `clownf service
+// mount`.
+func TestSAWaitFenceClearWaitsForFenceExpiry(t *testing.T) {
+	requireConsulBinary(t)
+
+	server, err := testutil.NewTestServerConfigT(t, nil)
+	if err != nil {
+		t.Fatalf("failed to start test Consul server: %v", err)
+	}
+	defer server.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: server.HTTPAddr})
+	if err != nil {
+		t.Fatalf("failed to create Consul client: %v", err)
+	}
+
+	logger := log.NewNullLogger()
+	const serviceName = "lustre-OST0000"
+	const lockKey = "barreleye/service/lustre-OST0000/lock"
+
+	sessionID, _, err := client.Session().Create(&api.SessionEntry{TTL: "10s"}, nil)
+	if err != nil {
+		t.Fatalf("failed to create a Consul session: %v", err)
+	}
+
+	acquired, _, err := client.KV().Acquire(
+		&api.KVPair{Key: lockKey, Value: []byte("leader-uuid"), Session: sessionID}, nil)
+	if err != nil || !acquired {
+		t.Fatalf("failed to acquire the lock key under the session: acquired=%v err=%v", acquired, err)
+	}
+
+	leader := &ServiceAgent{
+		SAServiceName:  serviceName,
+		SAConsulClient: client,
+		SAUuid:         "leader-uuid",
+		SALockKey:      lockKey,
+	}
+	successor := &ServiceAgent{
+		SAServiceName:  serviceName,
+		SAConsulClient: client,
+		SAUuid:         "successor-uuid",
+	}
+
+	// Leader publishes its fence entry (tied to its live session), then
+	// crashes: the session is never destroyed by the leader itself.
+	leader.SAPublishFence(logger, "host-a")
+
+	exitChannel := make(chan struct{})
+	defer close(exitChannel)
+
+	done := make(chan struct{})
+	go func() {
+		successor.SAWaitFenceClear(logger, exitChannel)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("successor returned from SAWaitFenceClear before the leader's session was invalidated")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if _, err := client.Session().Destroy(sessionID, nil); err != nil {
+		t.Fatalf("failed to destroy the leader's session: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("successor never returned from SAWaitFenceClear after the leader's session was destroyed")
+	}
+}
+
+// TestSAWaitFenceClearIgnoresOwnFence confirms a fence entry this agent
+// published itself (e.g. left over from a previous term as leader) does
+// not make it wait on itself.
+func TestSAWaitFenceClearIgnoresOwnFence(t *testing.T) {
+	requireConsulBinary(t)
+
+	server, err := testutil.NewTestServerConfigT(t, nil)
+	if err != nil {
+		t.Fatalf("failed to start test Consul server: %v", err)
+	}
+	defer server.Stop()
+
+	client, err := api.NewClient(&api.Config{Address: server.HTTPAddr})
+	if err != nil {
+		t.Fatalf("failed to create Consul client: %v", err)
+	}
+
+	logger := log.NewNullLogger()
+	const lockKey = "barreleye/service/lustre-OST0000/lock"
+
+	sessionID, _, err := client.Session().Create(&api.SessionEntry{TTL: "10s"}, nil)
+	if err != nil {
+		t.Fatalf("failed to create a Consul session: %v", err)
+	}
+
+	acquired, _, err := client.KV().Acquire(
+		&api.KVPair{Key: lockKey, Value: []byte("same-uuid"), Session: sessionID}, nil)
+	if err != nil || !acquired {
+		t.Fatalf("failed to acquire the lock key under the session: acquired=%v err=%v", acquired, err)
+	}
+
+	agent := &ServiceAgent{
+		SAServiceName:  "lustre-OST0000",
+		SAConsulClient: client,
+		SAUuid:         "same-uuid",
+		SALockKey:      lockKey,
+	}
+	agent.SAPublishFence(logger, "host-a")
+
+	exitChannel := make(chan struct{})
+	defer close(exitChannel)
+
+	done := make(chan struct{})
+	go func() {
+		agent.SAWaitFenceClear(logger, exitChannel)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("SAWaitFenceClear waited on the agent's own fence entry")
+	}
+}
+
+// TestSAPreReleaseHookUsesBackend confirms SAPreReleaseHook drives the
+// umount through agent.SABackend (here a MockBackend) instead of
+// shelling out to clownf directly, so --backend ssh/mock agents get a
+// consistent pre-release umount path.
+func TestSAPreReleaseHookUsesBackend(t *testing.T) {
+	backend := &MockBackend{}
+	agent := &ServiceAgent{
+		SAServiceName:       "lustre-OST0000",
+		SASessionTTLSeconds: 5,
+		SABackend:           backend,
+	}
+
+	agent.SAPreReleaseHook(log.NewNullLogger())
+
+	if len(backend.Calls) != 1 || backend.Calls[0] != "umount lustre-OST0000" {
+		t.Fatalf("expected exactly one umount call to the backend, got %v", backend.Calls)
+	}
+}
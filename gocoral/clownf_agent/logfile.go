@@ -0,0 +1,102 @@
+// Author: Li Xi
+//
+// A rotating file writer for the agent's log output, so --log-file can
+// be left pointed at a single path indefinitely instead of operators
+// wiring up logrotate themselves.
+//
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LogFile is an io.Writer that appends to Path, rotating to a
+// timestamped sibling file once it exceeds RotateBytes (if positive) or
+// has been open longer than RotateDuration (if positive).
+type LogFile struct {
+	Path           string
+	RotateBytes    int64
+	RotateDuration time.Duration
+
+	mutex     sync.Mutex
+	file      *os.File
+	bytes     int64
+	openedAt  time.Time
+}
+
+func (logFile *LogFile) Write(data []byte) (int, error) {
+	logFile.mutex.Lock()
+	defer logFile.mutex.Unlock()
+
+	if logFile.file == nil {
+		if err := logFile.open(); err != nil {
+			return 0, err
+		}
+	} else if logFile.shouldRotate() {
+		if err := logFile.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := logFile.file.Write(data)
+	logFile.bytes += int64(n)
+	return n, err
+}
+
+func (logFile *LogFile) shouldRotate() bool {
+	if logFile.RotateBytes > 0 && logFile.bytes >= logFile.RotateBytes {
+		return true
+	}
+	if logFile.RotateDuration > 0 && time.Since(logFile.openedAt) >= logFile.RotateDuration {
+		return true
+	}
+	return false
+}
+
+func (logFile *LogFile) open() error {
+	file, err := os.OpenFile(logFile.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	logFile.file = file
+	logFile.bytes = info.Size()
+	logFile.openedAt = time.Now()
+	return nil
+}
+
+func (logFile *LogFile) rotate() error {
+	if err := logFile.file.Close(); err != nil {
+		return err
+	}
+	logFile.file = nil
+
+	rotated := fmt.Sprintf("%s.%d", logFile.Path, time.Now().Unix())
+	if err := os.Rename(logFile.Path, rotated); err != nil {
+		return err
+	}
+	return logFile.open()
+}
+
+// newLogFile builds a LogFile for path, creating its parent directory if
+// necessary.
+func newLogFile(path string, rotateBytes int64, rotateDuration time.Duration) (*LogFile, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &LogFile{
+		Path:           path,
+		RotateBytes:    rotateBytes,
+		RotateDuration: rotateDuration,
+	}, nil
+}
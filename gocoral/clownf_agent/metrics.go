@@ -0,0 +1,167 @@
+// Author: Li Xi
+//
+// Metrics for service/host agent state. The Prometheus gauges/counters
+// below are scraped directly off the /metrics endpoint. Alongside them,
+// initTelemetry sets up an armon/go-metrics global sink (statsd/datadog/
+// prometheus/in-memory, selected by TelemetryConfig) for the named
+// counters/timers sprinkled through the monitor loops themselves (lock
+// acquisition, plan errors, version-check duration, session renewals),
+// so operators who already run a go-metrics-fed dashboard for other
+// HashiCorp-style daemons don't need a second scraping setup.
+//
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/datadog"
+	gometricsprom "github.com/armon/go-metrics/prometheus"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Numeric encoding of ServiceStatus/HostStatus for the status gauges,
+// since Prometheus gauges carry numbers, not strings.
+const (
+	metricsStatusUnknown = 0
+	metricsStatusUp      = 1
+	metricsStatusFailed  = 2
+)
+
+var (
+	metricsServiceStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "barreleye_service_status",
+		Help: "Status of a Lustre service: 0=unknown, 1=mounted, 2=mount failed.",
+	}, []string{"service", "fsname", "role"})
+
+	metricsServiceMountAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "barreleye_service_mount_attempts_total",
+		Help: "Total number of clownf service mount attempts.",
+	}, []string{"service"})
+
+	metricsServiceMountFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "barreleye_service_mount_failures_total",
+		Help: "Total number of failed clownf service mount attempts.",
+	}, []string{"service"})
+
+	metricsServiceMountDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "barreleye_service_mount_duration_seconds",
+		Help: "Duration of clownf service mount attempts.",
+	}, []string{"service"})
+
+	metricsHostStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "barreleye_host_status",
+		Help: "Status of a monitored host: 0=unknown, 1=started, 2=start failed.",
+	}, []string{"hostname"})
+
+	metricsLeader = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "barreleye_leader",
+		Help: "1 for the service/uuid pair currently holding the leadership lock.",
+	}, []string{"service", "uuid"})
+
+	metricsConsulLockAcquireSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "barreleye_consul_lock_acquire_seconds",
+		Help: "Time spent acquiring the Consul leadership lock.",
+	}, []string{"service"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricsServiceStatus,
+		metricsServiceMountAttemptsTotal,
+		metricsServiceMountFailuresTotal,
+		metricsServiceMountDurationSeconds,
+		metricsHostStatus,
+		metricsLeader,
+		metricsConsulLockAcquireSeconds,
+	)
+}
+
+func serviceStatusMetricValue(status ServiceStatus) float64 {
+	switch status {
+	case SSMounted:
+		return metricsStatusUp
+	case SSMountFailed:
+		return metricsStatusFailed
+	default:
+		return metricsStatusUnknown
+	}
+}
+
+func hostStatusMetricValue(status HostStatus) float64 {
+	switch status {
+	case HSStarted:
+		return metricsStatusUp
+	case HSStartFailed:
+		return metricsStatusFailed
+	default:
+		return metricsStatusUnknown
+	}
+}
+
+// serveMetrics starts the /metrics and /health HTTP endpoints on addr in
+// the background. An empty addr disables both endpoints.
+func serveMetrics(logger hclog.Logger, addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+	go func() {
+		logger.Info("serving metrics and health endpoints", "address", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			logger.Error("metrics server exited", "error", err, "address", addr)
+		}
+	}()
+}
+
+// initTelemetry configures the process-wide go-metrics sink used by the
+// barreleye.agent.lock.acquire.duration / barreleye.agent.plan.handler.
+// errors / barreleye.version_check.duration / barreleye.agent.session.
+// renewals metrics and the per-service lock holder gauge emitted from
+// the monitor loops. conf.TCSink selects the backing sink; an empty
+// TCSink defaults to "inmem" so the agent doesn't need a statsd/datadog
+// endpoint configured just to start.
+func initTelemetry(logger hclog.Logger, conf TelemetryConfig) error {
+	serviceName := conf.TCServiceName
+	if serviceName == "" {
+		serviceName = "barreleye"
+	}
+
+	var sink metrics.MetricSink
+	var err error
+	switch conf.TCSink {
+	case "", "inmem":
+		sink = metrics.NewInmemSink(10*time.Second, time.Minute)
+	case "statsd":
+		sink, err = metrics.NewStatsdSink(conf.TCAddr)
+	case "datadog":
+		sink, err = datadog.NewDogStatsdSink(conf.TCAddr, serviceName)
+	case "prometheus":
+		sink, err = gometricsprom.NewPrometheusSink()
+	default:
+		return fmt.Errorf("unknown telemetry sink: %s", conf.TCSink)
+	}
+	if err != nil {
+		logger.Error("failed to create telemetry sink", "error", err, "sink", conf.TCSink)
+		return err
+	}
+
+	metricsConfig := metrics.DefaultConfig(serviceName)
+	metricsConfig.EnableHostname = false
+	if _, err := metrics.NewGlobal(metricsConfig, sink); err != nil {
+		logger.Error("failed to init telemetry", "error", err)
+		return err
+	}
+	return nil
+}
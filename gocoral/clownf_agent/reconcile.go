@@ -0,0 +1,128 @@
+// Author: Li Xi
+//
+// Periodic reconciliation of the lock state an agent believes it holds
+// against what Consul actually has on SALockKey/HALockKey. The session
+// monitor inside api.Lock already closes leaderLostCh on most session
+// loss, but an out-of-band `consul kv delete` of the lock key, or a
+// partition the monitor missed, can otherwise leave an agent stuck
+// believing it is still the leader. Run alongside SAMonitorService/
+// HAMonitorHost, staggered with RandomStaggerQuarter so agents sharing a
+// Consul cluster don't all reconcile in lockstep.
+//
+// This only repairs the "we think we're leader but Consul disagrees"
+// case (release the stale lock). It does not re-register a missing
+// Consul service or recreate an expired session on the agent's behalf:
+// this agent never registers a Consul service/health check of its own
+// (SALockKey/HALockKey is a plain KV lock, not a catalog service), and a
+// session that has actually expired is exactly the "not held" case
+// above, already handled by releasing and letting SAMonitorServiceOnce/
+// HAMonitorHostOnce re-acquire (which creates a fresh session as a side
+// effect of api.Lock.Lock).
+//
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+// ReconcileInterval is the base period between drift checks.
+const ReconcileInterval = 60 * time.Second
+
+// SAReconcileOnce compares the locally-believed leadership state against
+// Consul's view of SALockKey, and forces a clean local release when
+// they've diverged so the next SAMonitorServiceOnce iteration re-attempts
+// acquisition from scratch instead of sitting on a lock Consul no longer
+// agrees we hold. Re-registration/session-recreation don't apply here;
+// see the package doc comment for why.
+func (agent *ServiceAgent) SAReconcileOnce(logger log.Logger) {
+	agent.SALeaderMutex.Lock()
+	believeLeader := agent.SAIsLeader
+	agent.SALeaderMutex.Unlock()
+
+	if !believeLeader {
+		return
+	}
+
+	held, leaderUUID, err := agent.SAGetLockValue(agent.SALockKey)
+	if err != nil {
+		logger.Warn("failed to reconcile lock state", "error", err)
+		return
+	}
+
+	if !held || leaderUUID != agent.SAUuid {
+		logger.Error("lock state diverged from Consul, forcing a clean release",
+			     "consul_held", held, "consul_leader", leaderUUID)
+		agent.SALeaderMutex.Lock()
+		agent.SAIsLeader = false
+		agent.SALeaderMutex.Unlock()
+		if err := agent.SAConsulLock.Unlock(); err != nil {
+			logger.Warn("failed to release already-diverged lock", "error", err)
+		}
+	}
+}
+
+// SAReconcile runs SAReconcileOnce on a jittered timer until exitChannel
+// closes.
+func (agent *ServiceAgent) SAReconcile(logger log.Logger, waitGroup *sync.WaitGroup,
+				       exitChannel <-chan struct{}) {
+	waitGroup.Add(1)
+	defer waitGroup.Done()
+
+	for {
+		select {
+		case <-time.After(RandomStaggerQuarter(ReconcileInterval)):
+			agent.SAReconcileOnce(logger)
+		case <-exitChannel:
+			return
+		}
+	}
+}
+
+// HAReconcileOnce is the host-agent equivalent of SAReconcileOnce, for
+// HALockKey.
+func (agent *HostAgent) HAReconcileOnce(logger log.Logger) {
+	agent.HALeaderMutex.Lock()
+	believeLeader := agent.HAIsLeader
+	agent.HALeaderMutex.Unlock()
+
+	if !believeLeader {
+		return
+	}
+
+	held, leaderUUID, err := agent.HAGetLockValue(agent.HALockKey)
+	if err != nil {
+		logger.Warn("failed to reconcile lock state", "error", err)
+		return
+	}
+
+	if !held || leaderUUID != agent.HAUuid {
+		logger.Error("lock state diverged from Consul, forcing a clean release",
+			     "consul_held", held, "consul_leader", leaderUUID)
+		agent.HALeaderMutex.Lock()
+		agent.HAIsLeader = false
+		agent.HALeaderMutex.Unlock()
+		if err := agent.HAConsulLock.Unlock(); err != nil {
+			logger.Warn("failed to release already-diverged lock", "error", err)
+		}
+	}
+}
+
+// HAReconcile runs HAReconcileOnce on a jittered timer until exitChannel
+// closes.
+func (agent *HostAgent) HAReconcile(logger log.Logger, waitGroup *sync.WaitGroup,
+				    exitChannel <-chan struct{}) {
+	waitGroup.Add(1)
+	defer waitGroup.Done()
+
+	for {
+		select {
+		case <-time.After(RandomStaggerQuarter(ReconcileInterval)):
+			agent.HAReconcileOnce(logger)
+		case <-exitChannel:
+			return
+		}
+	}
+}
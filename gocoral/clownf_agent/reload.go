@@ -0,0 +1,149 @@
+// Author: Li Xi
+//
+// SIGHUP-driven reload of the static Clownfish YAML config (CCSSHHosts,
+// CCHooks) without restarting the process. The per-service/per-host
+// RuntimeConfig (autostart, retry tuning, session TTL, backend) is
+// already live-reloadable via the SAPlanRun/HAPlanRun watch.Plan on its
+// Consul KV key, so reload only needs to touch what's actually sourced
+// from the YAML file: hook definitions, and which services/hosts this
+// node runs agents for.
+//
+package main
+
+import (
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+	log "github.com/hashicorp/go-hclog"
+	"github.com/LiXi-storage/barreleye/gocoral/hooks"
+)
+
+// runConfigReloader serially applies reload requests arriving on
+// configReloadCh, replying to each with the error (nil on success) on the
+// channel the caller sent. It runs until exitChannel closes.
+func runConfigReloader(logger log.Logger, consulConf *api.Config, backendConf BackendConfig,
+			hookRunner *hooks.Runner, waitGroup *sync.WaitGroup,
+			exitChannel chan struct{},
+			agents *[]*ServiceAgent, hostAgents *[]*HostAgent,
+			configReloadCh chan chan error) {
+	for {
+		select {
+		case respCh := <-configReloadCh:
+			respCh <- handleConfigReload(logger, consulConf, backendConf, hookRunner,
+						     waitGroup, exitChannel, agents, hostAgents)
+		case <-exitChannel:
+			return
+		}
+	}
+}
+
+// handleConfigReload re-reads the Clownfish YAML config, applies the new
+// hook definitions to every running agent in place, starts an agent for
+// any service/host newly present in the config, and cancels (via
+// SACancel/HACancel) the agent for any service/host that disappeared
+// from the config, removing it from *agents/*hostAgents.
+func handleConfigReload(logger log.Logger, consulConf *api.Config, backendConf BackendConfig,
+			 hookRunner *hooks.Runner, waitGroup *sync.WaitGroup,
+			 exitChannel chan struct{},
+			 agents *[]*ServiceAgent, hostAgents *[]*HostAgent) error {
+	newConfig, err := loadConfig(logger)
+	if err != nil {
+		logger.Error("failed to reload Clownfish config", "error", err)
+		return err
+	}
+
+	hookRunner.SetConfig(newConfig.CCHooks)
+
+	existingServices := make(map[string]bool)
+	for _, agent := range *agents {
+		existingServices[agent.SAServiceName] = true
+		agent.SAServiceHooks = newConfig.CCHooks.Services[agent.SAServiceName]
+	}
+
+	localService, err := filterLocalServices(logger, newConfig)
+	if err != nil {
+		logger.Error("failed to filter local services while reloading", "error", err)
+		return err
+	}
+
+	newServices := make(map[string]bool)
+	for _, serviceInstance := range localService.LSServiceInstances {
+		serviceName := serviceInstance.LSService.LSServiceName
+		newServices[serviceName] = true
+		if existingServices[serviceName] {
+			continue
+		}
+
+		agent, err := createServiceAgent(logger, consulConf, newConfig, backendConf,
+						  hookRunner, serviceInstance.LSService, exitChannel)
+		if err != nil {
+			logger.Error("failed to start agent for service added by reload",
+				     "error", err, "service", serviceName)
+			return err
+		}
+		logger.Info("starting agent for service added by config reload",
+			    "service", serviceName)
+		go agent.SAMonitorService(agent.SALogger, waitGroup, agent.SAExitChannel)
+		go agent.SAReconcile(agent.SALogger, waitGroup, agent.SAExitChannel)
+		*agents = append(*agents, agent)
+	}
+
+	var keptAgents []*ServiceAgent
+	for _, agent := range *agents {
+		if newServices[agent.SAServiceName] {
+			keptAgents = append(keptAgents, agent)
+			continue
+		}
+		logger.Warn("service removed from config by reload, stopping agent",
+			    "service", agent.SAServiceName)
+		agent.SACancel()
+	}
+	*agents = keptAgents
+
+	existingHosts := make(map[string]bool)
+	for _, hostAgent := range *hostAgents {
+		existingHosts[hostAgent.HASSHHost.SSHHostName] = true
+		hostAgent.HAHostHooks = newConfig.CCHooks.Hosts[hostAgent.HASSHHost.SSHHostName]
+	}
+
+	monitorList, err := hostMonitorList(logger, newConfig)
+	if err != nil {
+		logger.Error("failed to recompute host monitor list while reloading", "error", err)
+		return err
+	}
+
+	newHosts := make(map[string]bool)
+	for _, sshHost := range monitorList {
+		newHosts[sshHost.SSHHostName] = true
+		if existingHosts[sshHost.SSHHostName] {
+			continue
+		}
+
+		hostAgent, err := createHostAgent(logger, consulConf, newConfig, backendConf,
+						   hookRunner, sshHost, exitChannel)
+		if err != nil {
+			logger.Error("failed to start agent for host added by reload",
+				     "error", err, "hostname", sshHost.SSHHostName)
+			return err
+		}
+		logger.Info("starting agent for host added by config reload",
+			    "hostname", sshHost.SSHHostName)
+		go hostAgent.HAMonitorHost(hostAgent.HALogger, waitGroup, hostAgent.HAExitChannel)
+		go hostAgent.HAReconcile(hostAgent.HALogger, waitGroup, hostAgent.HAExitChannel)
+		*hostAgents = append(*hostAgents, hostAgent)
+	}
+
+	var keptHostAgents []*HostAgent
+	for _, hostAgent := range *hostAgents {
+		if newHosts[hostAgent.HASSHHost.SSHHostName] {
+			keptHostAgents = append(keptHostAgents, hostAgent)
+			continue
+		}
+		logger.Warn("host removed from config by reload, stopping agent",
+			    "hostname", hostAgent.HASSHHost.SSHHostName)
+		hostAgent.HACancel()
+	}
+	*hostAgents = keptHostAgents
+
+	return nil
+}
@@ -0,0 +1,129 @@
+// Author: Li Xi
+//
+// Backoff and circuit-breaking helpers for the service/host maintain
+// loops, so that a wedged `clownf service mount` / `clownf host start`
+// backs off instead of hammering Lustre/MGS every SASessionTTL.
+//
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/LiXi-storage/barreleye/gocoral/clock"
+)
+
+// Retryable is the signature of a retried operation: it returns whether
+// the caller should retry and the error observed on this attempt.
+// TimeoutRetryStrategy below does not invoke it; callers make each
+// attempt themselves and report it via RecordSuccess/RecordFailure.
+type Retryable func() (retry bool, err error)
+
+// TimeoutRetryStrategy is an exponential backoff with jitter and a
+// circuit breaker, modeled after the timeout-retry pattern used in the
+// SoftLayer/BOSH ecosystem. BaseInterval is doubled on every consecutive
+// failure up to MaxInterval, with a +/-JitterFraction of jitter applied
+// so peer agents don't retry in lockstep. After FailureThreshold
+// consecutive failures the circuit opens for CoolDownSeconds, during
+// which NextInterval returns BaseInterval (capped at the time left in the
+// cool-down) so the caller can still emit one heartbeat log per interval
+// without attempting the operation.
+type TimeoutRetryStrategy struct {
+	BaseInterval    time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	JitterFraction  float64
+	FailureThreshold int
+	CoolDownSeconds int
+
+	Clock clock.Clock
+
+	consecutiveFailures int
+	circuitOpenUntil    time.Time
+}
+
+// NewTimeoutRetryStrategy builds a TimeoutRetryStrategy from the
+// RuntimeConfig fields watched through Consul KV, falling back to the
+// real clock.
+func NewTimeoutRetryStrategy(conf RuntimeConfig) *TimeoutRetryStrategy {
+	return &TimeoutRetryStrategy{
+		BaseInterval:     time.Duration(conf.RCRetryBaseSeconds) * time.Second,
+		MaxInterval:      time.Duration(conf.RCRetryMaxSeconds) * time.Second,
+		Multiplier:       2,
+		JitterFraction:   0.2,
+		FailureThreshold: conf.RCFailureThreshold,
+		CoolDownSeconds:  conf.RCCoolDownSeconds,
+		Clock:            clock.New(),
+	}
+}
+
+// CircuitOpen returns whether the breaker is currently suppressing
+// attempts, e.g. after FailureThreshold consecutive failures.
+func (strategy *TimeoutRetryStrategy) CircuitOpen() bool {
+	if strategy.circuitOpenUntil.IsZero() {
+		return false
+	}
+	return strategy.clock().Now().Before(strategy.circuitOpenUntil)
+}
+
+// RecordSuccess resets the failure count and closes the circuit.
+func (strategy *TimeoutRetryStrategy) RecordSuccess() {
+	strategy.consecutiveFailures = 0
+	strategy.circuitOpenUntil = time.Time{}
+}
+
+// RecordFailure bumps the consecutive failure count, opening the
+// circuit once FailureThreshold is reached.
+func (strategy *TimeoutRetryStrategy) RecordFailure() {
+	strategy.consecutiveFailures++
+	if strategy.FailureThreshold > 0 && strategy.consecutiveFailures >= strategy.FailureThreshold {
+		strategy.circuitOpenUntil = strategy.clock().Now().Add(
+			time.Duration(strategy.CoolDownSeconds) * time.Second)
+	}
+}
+
+// NextInterval returns how long to wait before the next attempt (or
+// heartbeat log, while the circuit is open), doubling the base interval
+// per consecutive failure up to MaxInterval and adding jitter.
+func (strategy *TimeoutRetryStrategy) NextInterval() time.Duration {
+	if strategy.CircuitOpen() {
+		remaining := strategy.circuitOpenUntil.Sub(strategy.clock().Now())
+		if strategy.BaseInterval > 0 && strategy.BaseInterval < remaining {
+			return strategy.BaseInterval
+		}
+		return remaining
+	}
+
+	interval := strategy.BaseInterval
+	for i := 0; i < strategy.consecutiveFailures; i++ {
+		interval = time.Duration(float64(interval) * strategy.Multiplier)
+		if strategy.MaxInterval > 0 && interval > strategy.MaxInterval {
+			interval = strategy.MaxInterval
+			break
+		}
+	}
+
+	if strategy.JitterFraction <= 0 {
+		return interval
+	}
+	jitterRange := float64(interval) * strategy.JitterFraction
+	jitter := (rand.Float64()*2 - 1) * jitterRange
+	return time.Duration(float64(interval) + jitter)
+}
+
+// applyTuning refreshes the interval/threshold knobs from a RuntimeConfig
+// that may have changed via the Consul KV watch, without resetting the
+// in-flight failure count or open circuit.
+func (strategy *TimeoutRetryStrategy) applyTuning(conf RuntimeConfig) {
+	strategy.BaseInterval = time.Duration(conf.RCRetryBaseSeconds) * time.Second
+	strategy.MaxInterval = time.Duration(conf.RCRetryMaxSeconds) * time.Second
+	strategy.FailureThreshold = conf.RCFailureThreshold
+	strategy.CoolDownSeconds = conf.RCCoolDownSeconds
+}
+
+func (strategy *TimeoutRetryStrategy) clock() clock.Clock {
+	if strategy.Clock == nil {
+		return clock.New()
+	}
+	return strategy.Clock
+}
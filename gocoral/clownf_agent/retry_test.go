@@ -0,0 +1,50 @@
+// Author: Li Xi
+//
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LiXi-storage/barreleye/gocoral/clock"
+)
+
+// TestTimeoutRetryStrategyCircuitBreaker drives a TimeoutRetryStrategy on
+// a clock.FakeClock so the circuit-open/cool-down window can be asserted
+// deterministically instead of depending on real wall time.
+func TestTimeoutRetryStrategyCircuitBreaker(t *testing.T) {
+	fake := clock.NewFakeClock(time.Unix(0, 0))
+	strategy := &TimeoutRetryStrategy{
+		BaseInterval:     time.Second,
+		MaxInterval:      10 * time.Second,
+		Multiplier:       2,
+		FailureThreshold: 2,
+		CoolDownSeconds:  30,
+		Clock:            fake,
+	}
+
+	strategy.RecordFailure()
+	if strategy.CircuitOpen() {
+		t.Fatal("circuit opened after only one failure, want it closed until FailureThreshold")
+	}
+
+	strategy.RecordFailure()
+	if !strategy.CircuitOpen() {
+		t.Fatal("circuit did not open after reaching FailureThreshold consecutive failures")
+	}
+
+	fake.Advance(29 * time.Second)
+	if !strategy.CircuitOpen() {
+		t.Fatal("circuit closed before CoolDownSeconds elapsed")
+	}
+
+	fake.Advance(2 * time.Second)
+	if strategy.CircuitOpen() {
+		t.Fatal("circuit stayed open past CoolDownSeconds")
+	}
+
+	strategy.RecordSuccess()
+	if strategy.CircuitOpen() {
+		t.Fatal("RecordSuccess did not close the circuit")
+	}
+}
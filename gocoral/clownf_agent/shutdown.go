@@ -0,0 +1,120 @@
+// Author: Li Xi
+//
+// Two-phase graceful shutdown: closing exitChannel asks every agent
+// goroutine to finish on its own (releasing whatever lock it holds, as
+// SAMonitorServiceOnce/HAMonitorHostOnce already do on their exitChannel
+// branch), but a stuck mount/umount or hook can block that for longer
+// than a waiting peer agent's SASessionTTL. runGracefulShutdown bounds
+// that wait by GracefulTimeout and force-releases any lock still held
+// past the deadline so failover isn't stuck behind a shutdown that never
+// finishes.
+//
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+)
+
+// runGracefulShutdown signals all agents to exit, waits up to
+// gracefulTimeout for waitGroup to drain, and force-releases the lock of
+// any agent still holding it past the deadline. A second SIGINT received
+// while waiting exits the process immediately, matching the Consul
+// agent's "double signal to force" behavior.
+func runGracefulShutdown(logger log.Logger, exitChannel chan struct{},
+			  waitGroup *sync.WaitGroup,
+			  agents []*ServiceAgent, hostAgents []*HostAgent,
+			  gracefulTimeout time.Duration) {
+	logger.Info("starting graceful shutdown", "timeout", gracefulTimeout)
+	close(exitChannel)
+
+	drainDone := make(chan struct{})
+	go func() {
+		waitGroup.Wait()
+		close(drainDone)
+	}()
+
+	forceChannel := make(chan os.Signal, 1)
+	signal.Notify(forceChannel, syscall.SIGINT)
+	defer signal.Stop(forceChannel)
+
+	select {
+	case <-drainDone:
+		logger.Info("all agents drained before the graceful timeout")
+		return
+	case <-forceChannel:
+		logger.Warn("received a second signal, exiting immediately")
+		os.Exit(1)
+	case <-time.After(gracefulTimeout):
+	}
+
+	logger.Error("graceful timeout expired, forcing lock release on agents that did not drain",
+		     "timeout", gracefulTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), gracefulTimeout)
+	defer cancel()
+
+	for _, agent := range agents {
+		agent.SAForceRelease(ctx, agent.SALogger)
+	}
+	for _, hostAgent := range hostAgents {
+		hostAgent.HAForceRelease(ctx, hostAgent.HALogger)
+	}
+
+	select {
+	case <-drainDone:
+	case <-ctx.Done():
+		logger.Error("agents still running after forced lock release", "error", ctx.Err())
+	}
+}
+
+// SAForceRelease releases the lock and destroys the session this agent
+// created for it if SAReconcile/SAMonitorServiceOnce haven't already done
+// so, so a peer doesn't have to wait out the full SASessionTTL to fail
+// over. This agent doesn't register any Consul health checks of its own,
+// so there's nothing to deregister beyond the lock's session.
+func (agent *ServiceAgent) SAForceRelease(ctx context.Context, logger log.Logger) {
+	agent.SALeaderMutex.Lock()
+	wasLeader := agent.SAIsLeader
+	agent.SAIsLeader = false
+	agent.SALeaderMutex.Unlock()
+	if !wasLeader {
+		return
+	}
+
+	logger.Warn("forcing release of leadership lock that did not drain in time",
+		    "deadline_exceeded", ctx.Err() != nil)
+	agent.SAPreReleaseHook(logger)
+	if err := agent.SAConsulLock.Unlock(); err != nil {
+		logger.Error("failed to force-release the leadership lock", "error", err)
+	}
+	if err := agent.SAConsulLock.Destroy(); err != nil {
+		logger.Error("failed to destroy the leadership lock's session", "error", err)
+	}
+}
+
+// HAForceRelease is the host-agent equivalent of SAForceRelease, for
+// HAConsulLock.
+func (agent *HostAgent) HAForceRelease(ctx context.Context, logger log.Logger) {
+	agent.HALeaderMutex.Lock()
+	wasLeader := agent.HAIsLeader
+	agent.HAIsLeader = false
+	agent.HALeaderMutex.Unlock()
+	if !wasLeader {
+		return
+	}
+
+	logger.Warn("forcing release of leadership lock that did not drain in time",
+		    "deadline_exceeded", ctx.Err() != nil)
+	if err := agent.HAConsulLock.Unlock(); err != nil {
+		logger.Error("failed to force-release the leadership lock", "error", err)
+	}
+	if err := agent.HAConsulLock.Destroy(); err != nil {
+		logger.Error("failed to destroy the leadership lock's session", "error", err)
+	}
+}
@@ -0,0 +1,230 @@
+// Author: Li Xi
+//
+// Package hooks implements consul-template style pre/post hooks for
+// barreleye: per-service and per-host hook commands whose command line
+// and environment are rendered from Go templates with access to the
+// Lustre/SSH config, the runtime config, and arbitrary Consul KV keys.
+// Hooks re-render and re-run whenever a referenced KV key changes,
+// reusing the same watch.Plan infrastructure as the agent's config
+// watch, and are deduplicated so a burst of KV writes only triggers one
+// run per MinRenderInterval.
+//
+package hooks
+
+import (
+	"bytes"
+	"os/exec"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/consul/api/watch"
+	log "github.com/hashicorp/go-hclog"
+)
+
+// HookSpec is one hook definition: a command line template and the
+// environment it runs with.
+type HookSpec struct {
+	Command string            `toml:"command" yaml:"command"`
+	Env     map[string]string `toml:"env" yaml:"env"`
+	// KVKeys are Consul KV paths the command/env templates reference;
+	// the hook is re-rendered and re-run whenever one of them changes.
+	KVKeys []string `toml:"kv_keys" yaml:"kv_keys"`
+}
+
+// ServiceHooks are the hooks available for a Lustre service instance.
+type ServiceHooks struct {
+	PreMount       *HookSpec `toml:"pre_mount" yaml:"pre_mount"`
+	PostMount      *HookSpec `toml:"post_mount" yaml:"post_mount"`
+	PreUmount      *HookSpec `toml:"pre_umount" yaml:"pre_umount"`
+	OnStatusChange *HookSpec `toml:"on_status_change" yaml:"on_status_change"`
+	OnLeaderLost   *HookSpec `toml:"on_leader_lost" yaml:"on_leader_lost"`
+}
+
+// HostHooks are the hooks available for a monitored host.
+type HostHooks struct {
+	OnLeaderLost *HookSpec `toml:"on_leader_lost" yaml:"on_leader_lost"`
+}
+
+// Config is the top-level `hooks:` section of ClownfishConfig, keyed by
+// service name / hostname.
+type Config struct {
+	MinRenderIntervalSeconds int                     `toml:"min_render_interval" yaml:"min_render_interval"`
+	Services                 map[string]ServiceHooks `toml:"services" yaml:"services"`
+	Hosts                    map[string]HostHooks    `toml:"hosts" yaml:"hosts"`
+}
+
+// TemplateData is the data made available to a hook's Command/Env
+// templates.
+type TemplateData struct {
+	Service interface{}
+	Host    interface{}
+	Runtime interface{}
+	KV      map[string]string
+}
+
+// Runner renders and invokes hooks, watching any KV keys they reference
+// so they re-render when those values change.
+type Runner struct {
+	logger log.Logger
+	client *api.Client
+	conf   Config
+
+	mutex      sync.Mutex
+	lastRender map[string]time.Time
+}
+
+// NewRunner builds a Runner for the given hooks config.
+func NewRunner(logger log.Logger, client *api.Client, conf Config) *Runner {
+	return &Runner{
+		logger:     logger,
+		client:     client,
+		conf:       conf,
+		lastRender: make(map[string]time.Time),
+	}
+}
+
+func (runner *Runner) minRenderInterval() time.Duration {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	if runner.conf.MinRenderIntervalSeconds <= 0 {
+		return time.Second
+	}
+	return time.Duration(runner.conf.MinRenderIntervalSeconds) * time.Second
+}
+
+// SetConfig replaces the hooks config consulted by minRenderInterval, so a
+// config reload can pick up a changed min_render_interval without
+// restarting the agent. Per-service/per-host HookSpecs are looked up by
+// the caller and passed into Invoke/WatchHookKeys directly, so reloading
+// those only requires updating the caller's own copy, not the Runner.
+func (runner *Runner) SetConfig(conf Config) {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	runner.conf = conf
+}
+
+// render expands the Command/Env templates of spec against data.
+func render(spec *HookSpec, data TemplateData) (string, map[string]string, error) {
+	commandTmpl, err := template.New("command").Parse(spec.Command)
+	if err != nil {
+		return "", nil, err
+	}
+	var commandBuf bytes.Buffer
+	if err := commandTmpl.Execute(&commandBuf, data); err != nil {
+		return "", nil, err
+	}
+
+	env := make(map[string]string, len(spec.Env))
+	for key, value := range spec.Env {
+		envTmpl, err := template.New(key).Parse(value)
+		if err != nil {
+			return "", nil, err
+		}
+		var envBuf bytes.Buffer
+		if err := envTmpl.Execute(&envBuf, data); err != nil {
+			return "", nil, err
+		}
+		env[key] = envBuf.String()
+	}
+
+	return commandBuf.String(), env, nil
+}
+
+// Invoke renders and runs spec, deduplicating rapid re-invocations of
+// the same dedupKey within MinRenderInterval.
+func (runner *Runner) Invoke(dedupKey string, spec *HookSpec, data TemplateData) {
+	if spec == nil {
+		return
+	}
+
+	interval := runner.minRenderInterval()
+	runner.mutex.Lock()
+	last, ok := runner.lastRender[dedupKey]
+	now := time.Now()
+	if ok && now.Sub(last) < interval {
+		runner.mutex.Unlock()
+		return
+	}
+	runner.lastRender[dedupKey] = now
+	runner.mutex.Unlock()
+
+	command, env, err := render(spec, data)
+	if err != nil {
+		runner.logger.Error("failed to render hook", "hook", dedupKey, "error", err)
+		return
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		runner.logger.Error("hook command failed", "hook", dedupKey, "error", err,
+				    "stdout", stdout.String(), "stderr", stderr.String())
+		return
+	}
+	runner.logger.Info("ran hook", "hook", dedupKey, "stdout", stdout.String())
+}
+
+// WatchKey re-invokes onChange with the new KV value whenever key
+// changes, reusing the same watch.Plan infrastructure as the agent's
+// own config watch.
+func (runner *Runner) WatchKey(key string, onChange func(value string)) error {
+	params := map[string]interface{}{
+		"type": "key",
+		"key":  key,
+	}
+	plan, err := watch.Parse(params)
+	if err != nil {
+		return err
+	}
+
+	plan.Handler = func(idx uint64, raw interface{}) {
+		if raw == nil {
+			onChange("")
+			return
+		}
+		pair, ok := raw.(*api.KVPair)
+		if !ok {
+			return
+		}
+		onChange(string(pair.Value))
+	}
+
+	go func() {
+		err := plan.RunWithClientAndHclog(runner.client, runner.logger)
+		if err != nil {
+			runner.logger.Error("failed to run hook watch plan", "key", key, "error", err)
+		}
+	}()
+	return nil
+}
+
+// WatchHookKeys starts a watch for every KV key referenced by spec,
+// re-invoking spec whenever one of them changes.
+func (runner *Runner) WatchHookKeys(dedupKey string, spec *HookSpec, data TemplateData) {
+	if spec == nil {
+		return
+	}
+	for _, key := range spec.KVKeys {
+		key := key
+		err := runner.WatchKey(key, func(value string) {
+			invokeData := data
+			invokeData.KV = make(map[string]string, len(data.KV)+1)
+			for k, v := range data.KV {
+				invokeData.KV[k] = v
+			}
+			invokeData.KV[key] = value
+			runner.Invoke(dedupKey, spec, invokeData)
+		})
+		if err != nil {
+			runner.logger.Error("failed to watch hook key", "hook", dedupKey, "key", key, "error", err)
+		}
+	}
+}
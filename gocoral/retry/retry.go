@@ -0,0 +1,77 @@
+// Author: Li Xi
+//
+// Package retry provides a timeout-bounded retry loop for fragile
+// startup-time operations (dialing Consul, acquiring a lock, filtering
+// local services) so transient unavailability doesn't abort the agent
+// outright. This is deliberately a different shape from the
+// clownf_agent package's own TimeoutRetryStrategy, which backs off and
+// circuit-breaks an indefinitely-running mount/start loop; this one
+// polls at a fixed interval until the operation stops asking for a
+// retry, a deadline (if set) passes, or the exit channel closes, and
+// returns the final error to the caller.
+//
+package retry
+
+import (
+	"time"
+
+	"github.com/LiXi-storage/barreleye/gocoral/clock"
+)
+
+// Retryable is one attempt of a fragile operation: Try reports whether
+// it should be retried and the error observed on this attempt.
+type Retryable interface {
+	Try() (retry bool, err error)
+}
+
+// RetryableFunc adapts a plain function to Retryable.
+type RetryableFunc func() (retry bool, err error)
+
+func (f RetryableFunc) Try() (bool, error) {
+	return f()
+}
+
+// TimeoutRetryStrategy repeatedly invokes a Retryable on PollingInterval
+// until it reports retry=false, Timeout elapses since the first attempt,
+// or exitChannel closes. A non-positive Timeout means retry until
+// retry=false or exitChannel closes, with no deadline.
+type TimeoutRetryStrategy struct {
+	Timeout         time.Duration
+	PollingInterval time.Duration
+	Clock           clock.Clock
+}
+
+func (strategy TimeoutRetryStrategy) clk() clock.Clock {
+	if strategy.Clock == nil {
+		return clock.New()
+	}
+	return strategy.Clock
+}
+
+// Run drives retryable to completion as described above and returns the
+// error from the last attempt.
+func (strategy TimeoutRetryStrategy) Run(retryable Retryable, exitChannel <-chan struct{}) error {
+	clk := strategy.clk()
+	var deadline time.Time
+	if strategy.Timeout > 0 {
+		deadline = clk.Now().Add(strategy.Timeout)
+	}
+
+	var lastErr error
+	for {
+		retry, err := retryable.Try()
+		lastErr = err
+		if !retry {
+			return err
+		}
+		if !deadline.IsZero() && !clk.Now().Before(deadline) {
+			return err
+		}
+
+		select {
+		case <-clk.After(strategy.PollingInterval):
+		case <-exitChannel:
+			return lastErr
+		}
+	}
+}